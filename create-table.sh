@@ -3,4 +3,6 @@
 echo "Localstack deployed. Create dynamodb table..."
 source ./local-stack-env.sh
 aws dynamodb create-table --no-cli-pager --table-name my-table --endpoint-url ${AWS_ENDPOINT_URL} --cli-input-json file://./dynamodb-table.json 1> /dev/null
+aws dynamodb create-table --no-cli-pager --table-name my-idempotency --endpoint-url ${AWS_ENDPOINT_URL} --cli-input-json file://./idempotency-table.json 1> /dev/null
+aws dynamodb update-time-to-live --no-cli-pager --table-name my-idempotency --endpoint-url ${AWS_ENDPOINT_URL} --time-to-live-specification Enabled=true,AttributeName=expiresAt 1> /dev/null
 echo "Dynamodb tables created."
\ No newline at end of file
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"log-trace-testing/pkg/config"
+	"log-trace-testing/pkg/messaging"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthServer serves the kubernetes probes and the diagnostics. It starts before the rest of the
+// service: the checks are added as the dependencies are built, and the service is not ready until
+// the processor has subscribed.
+type healthServer struct {
+	logger    *log.Entry
+	cfg       *config.Config
+	started   time.Time
+	mu        sync.Mutex
+	checks    []readinessCheck
+	processor messaging.MessageProcessor
+}
+
+func newHealthServer(logger *log.Entry, cfg *config.Config) *healthServer {
+	return &healthServer{
+		logger:  logger.WithField("address", cfg.HTTP.Address),
+		cfg:     cfg,
+		started: time.Now(),
+	}
+}
+
+func (h *healthServer) addCheck(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, readinessCheck{name: name, check: check})
+}
+
+// setProcessor adds the NATS connection and subscriptions checks and the processor diagnostics
+func (h *healthServer) setProcessor(processor messaging.MessageProcessor) {
+	h.addCheck("nats", func(context.Context) error {
+		state := processor.ConnectionState()
+		if state.Connected {
+			return nil
+		}
+		if state.LastError != "" {
+			return fmt.Errorf("connection %s: %s", strings.ToLower(state.Status), state.LastError)
+		}
+		return fmt.Errorf("connection %s", strings.ToLower(state.Status))
+	})
+	h.addCheck("subscriptions", func(context.Context) error {
+		subscriptions := processor.Subscriptions()
+		if len(subscriptions) == 0 {
+			return errors.New("not subscribed")
+		}
+		var inactive []string
+		for _, subscription := range subscriptions {
+			if !subscription.Active {
+				inactive = append(inactive, subscription.Subject)
+			}
+		}
+		if len(inactive) > 0 {
+			return fmt.Errorf("inactive subscriptions: %s", strings.Join(inactive, ", "))
+		}
+		return nil
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.processor = processor
+}
+
+func (h *healthServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", h.healthz)
+	mux.HandleFunc("GET /readyz", h.readyz)
+	if h.cfg.HTTP.Debug {
+		mux.HandleFunc("GET /debug", h.debug)
+	}
+	return mux
+}
+
+func (h *healthServer) start() *http.Server {
+	server := &http.Server{
+		Addr:              h.cfg.HTTP.Address,
+		Handler:           h.handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		h.logger.Info("Starting health endpoints")
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			h.logger.WithError(err).Error("Health endpoints failed")
+		}
+	}()
+
+	return server
+}
+
+// healthz only tells the process is alive
+func (h *healthServer) healthz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz runs every check concurrently, within the readiness timeout
+func (h *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	checks := append([]readinessCheck(nil), h.checks...)
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.cfg.HTTP.ReadinessTimeout.Duration())
+	defer cancel()
+
+	results := make([]string, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = "ok"
+			if err := check.check(ctx); err != nil {
+				results[i] = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	response := map[string]any{"status": "ready"}
+	details := map[string]string{}
+	for i, check := range checks {
+		details[check.name] = results[i]
+		if results[i] != "ok" {
+			status = http.StatusServiceUnavailable
+			response["status"] = "not ready"
+		}
+	}
+	response["checks"] = details
+
+	if status != http.StatusOK {
+		h.logger.WithField("checks", details).Warn("Readiness check failed")
+	}
+	writeJSON(w, status, response)
+}
+
+type buildInfo struct {
+	GoVersion string `json:"goVersion"`
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func readBuildInfo() buildInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return buildInfo{}
+	}
+	build := buildInfo{
+		GoVersion: info.GoVersion,
+		Module:    info.Main.Path,
+		Version:   info.Main.Version,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.Time = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
+
+// debug lists the subscriptions with their pending counts, the connection and the build
+func (h *healthServer) debug(w http.ResponseWriter, _ *http.Request) {
+	h.mu.Lock()
+	processor := h.processor
+	h.mu.Unlock()
+
+	response := map[string]any{
+		"application": h.cfg.App.Name,
+		"startedAt":   h.started.UTC().Format(time.RFC3339),
+		"uptime":      time.Since(h.started).Round(time.Second).String(),
+		"build":       readBuildInfo(),
+	}
+	if processor != nil {
+		response["connection"] = processor.ConnectionState()
+		response["subscriptions"] = processor.Subscriptions()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// exportStatus keeps the outcome of the last export of an exporter, it is healthy until an export fails
+type exportStatus struct {
+	mu      sync.Mutex
+	lastErr error
+	at      time.Time
+}
+
+func (s *exportStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	s.at = time.Now()
+}
+
+func (s *exportStatus) check(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastErr != nil {
+		return fmt.Errorf("last export at %s failed: %w", s.at.UTC().Format(time.RFC3339), s.lastErr)
+	}
+	return nil
+}
+
+type monitoredSpanExporter struct {
+	sdktrace.SpanExporter
+	status *exportStatus
+}
+
+func (e monitoredSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	e.status.record(err)
+	return err
+}
+
+type monitoredLogExporter struct {
+	sdklog.Exporter
+	status *exportStatus
+}
+
+func (e monitoredLogExporter) Export(ctx context.Context, records []sdklog.Record) error {
+	err := e.Exporter.Export(ctx, records)
+	e.status.record(err)
+	return err
+}
+
+type monitoredMetricExporter struct {
+	sdkmetric.Exporter
+	status *exportStatus
+}
+
+func (e monitoredMetricExporter) Export(ctx context.Context, metrics *metricdata.ResourceMetrics) error {
+	err := e.Exporter.Export(ctx, metrics)
+	e.status.record(err)
+	return err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"log-trace-testing/pkg/config"
+	"log-trace-testing/pkg/messaging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubProcessor reports a fixed connection and subscriptions state
+type stubProcessor struct {
+	messaging.MessageProcessor
+	connection    messaging.ConnectionState
+	subscriptions []messaging.SubscriptionState
+}
+
+func (s stubProcessor) ConnectionState() messaging.ConnectionState {
+	return s.connection
+}
+
+func (s stubProcessor) Subscriptions() []messaging.SubscriptionState {
+	return s.subscriptions
+}
+
+func newTestHealthServer(t *testing.T, debug bool) (*healthServer, *httptest.Server) {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	cfg := &config.Config{HTTP: config.HTTPConfig{Debug: debug, ReadinessTimeout: config.Duration(100 * time.Millisecond)}}
+	health := newHealthServer(log.NewEntry(logger), cfg)
+	server := httptest.NewServer(health.handler())
+	t.Cleanup(server.Close)
+	return health, server
+}
+
+func getJSON(t *testing.T, url string, body any) int {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("get %s: %v", url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		if contentType := response.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("got content type %q, want json", contentType)
+		}
+		err = json.NewDecoder(response.Body).Decode(body)
+		if err != nil {
+			t.Fatalf("decode %s: %v", url, err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestHealthz(t *testing.T) {
+	_, server := newTestHealthServer(t, false)
+
+	var body map[string]string
+	status := getJSON(t, server.URL+"/healthz", &body)
+	if status != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("got %d %v, want 200 ok", status, body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	connected := messaging.ConnectionState{Status: "CONNECTED", Connected: true}
+	subscribed := []messaging.SubscriptionState{{Subject: "create", Active: true}, {Subject: "get", Active: true}}
+	tests := []struct {
+		name       string
+		processor  *stubProcessor
+		check      func(ctx context.Context) error
+		wantStatus int
+		wantChecks map[string]string
+	}{
+		{
+			name:       "ready",
+			processor:  &stubProcessor{connection: connected, subscriptions: subscribed},
+			wantStatus: http.StatusOK,
+			wantChecks: map[string]string{"nats": "ok", "subscriptions": "ok", "exporter": "ok"},
+		},
+		{
+			name: "disconnected",
+			processor: &stubProcessor{
+				connection:    messaging.ConnectionState{Status: "RECONNECTING", LastError: "connection reset"},
+				subscriptions: subscribed,
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"nats": "connection reconnecting: connection reset", "subscriptions": "ok", "exporter": "ok"},
+		},
+		{
+			name:       "not subscribed",
+			processor:  &stubProcessor{connection: connected},
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"nats": "ok", "subscriptions": "not subscribed", "exporter": "ok"},
+		},
+		{
+			name: "inactive subscription",
+			processor: &stubProcessor{
+				connection:    connected,
+				subscriptions: []messaging.SubscriptionState{{Subject: "create"}, {Subject: "get", Active: true}},
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"nats": "ok", "subscriptions": "inactive subscriptions: create", "exporter": "ok"},
+		},
+		{
+			name:       "failed check",
+			processor:  &stubProcessor{connection: connected, subscriptions: subscribed},
+			check:      func(context.Context) error { return errors.New("export failed") },
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"nats": "ok", "subscriptions": "ok", "exporter": "export failed"},
+		},
+		{
+			name:      "check over the timeout",
+			processor: &stubProcessor{connection: connected, subscriptions: subscribed},
+			check: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantChecks: map[string]string{"nats": "ok", "subscriptions": "ok", "exporter": context.DeadlineExceeded.Error()},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			health, server := newTestHealthServer(t, false)
+			check := test.check
+			if check == nil {
+				check = func(context.Context) error { return nil }
+			}
+			health.addCheck("exporter", check)
+			health.setProcessor(test.processor)
+
+			var body struct {
+				Status string            `json:"status"`
+				Checks map[string]string `json:"checks"`
+			}
+			status := getJSON(t, server.URL+"/readyz", &body)
+			if status != test.wantStatus {
+				t.Errorf("got status %d, want %d", status, test.wantStatus)
+			}
+			if wantReady := test.wantStatus == http.StatusOK; (body.Status == "ready") != wantReady {
+				t.Errorf("got %q, want ready %t", body.Status, wantReady)
+			}
+			for name, want := range test.wantChecks {
+				if got := body.Checks[name]; got != want {
+					t.Errorf("got check %s %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyzBeforeProcessor(t *testing.T) {
+	health, server := newTestHealthServer(t, false)
+	status := &exportStatus{}
+	health.addCheck("exporter", status.check)
+
+	var body map[string]any
+	if got := getJSON(t, server.URL+"/readyz", &body); got != http.StatusOK {
+		t.Errorf("got status %d, want 200 while the exporter is healthy", got)
+	}
+	status.record(errors.New("connection refused"))
+	if got := getJSON(t, server.URL+"/readyz", &body); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503 after a failed export", got)
+	}
+	status.record(nil)
+	if got := getJSON(t, server.URL+"/readyz", &body); got != http.StatusOK {
+		t.Errorf("got status %d, want 200 after a successful export", got)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	tests := []struct {
+		name       string
+		debug      bool
+		processor  *stubProcessor
+		wantStatus int
+	}{
+		{name: "disabled", wantStatus: http.StatusNotFound},
+		{name: "before processor", debug: true, wantStatus: http.StatusOK},
+		{
+			name:  "with processor",
+			debug: true,
+			processor: &stubProcessor{
+				connection:    messaging.ConnectionState{Status: "CONNECTED", Connected: true, Reconnects: 2},
+				subscriptions: []messaging.SubscriptionState{{Subject: "create", Active: true, PendingMessages: 3}},
+			},
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			health, server := newTestHealthServer(t, test.debug)
+			if test.processor != nil {
+				health.setProcessor(test.processor)
+			}
+
+			var body struct {
+				StartedAt     string                        `json:"startedAt"`
+				Build         *buildInfo                    `json:"build"`
+				Connection    *messaging.ConnectionState    `json:"connection"`
+				Subscriptions []messaging.SubscriptionState `json:"subscriptions"`
+			}
+			status := getJSON(t, server.URL+"/debug", &body)
+			if status != test.wantStatus {
+				t.Fatalf("got status %d, want %d", status, test.wantStatus)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			if body.StartedAt == "" || body.Build == nil {
+				t.Error("debug without start time and build")
+			}
+			if test.processor == nil {
+				if body.Connection != nil || body.Subscriptions != nil {
+					t.Error("debug with a connection before the processor")
+				}
+				return
+			}
+			if body.Connection == nil || *body.Connection != test.processor.connection {
+				t.Errorf("got connection %+v, want %+v", body.Connection, test.processor.connection)
+			}
+			if len(body.Subscriptions) != 1 || body.Subscriptions[0] != test.processor.subscriptions[0] {
+				t.Errorf("got subscriptions %+v, want %+v", body.Subscriptions, test.processor.subscriptions)
+			}
+		})
+	}
+}
@@ -2,27 +2,39 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/yukitsune/lokirus"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	"go.opentelemetry.io/otel/trace"
+	"log-trace-testing/pkg/config"
+	"log-trace-testing/pkg/db"
 	"log-trace-testing/pkg/messaging"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
-const appName = "my-test-application"
-
-func prepareForSendingLogsToLoki(logger *log.Logger) {
+func prepareForSendingLogsToLoki(logger *log.Logger, cfg *config.Config) {
 
 	tracingLabels := func(entry *log.Entry) lokirus.Labels {
 		loggerCtx := entry.Context
@@ -53,11 +65,11 @@ func prepareForSendingLogsToLoki(logger *log.Logger) {
 		WithFormatter(&log.JSONFormatter{}).
 		WithDynamicLabelProvider(tracingLabels).
 		WithStaticLabels(lokirus.Labels{
-			"app": appName,
+			"app": cfg.App.Name,
 		})
 
 	hook := lokirus.NewLokiHookWithOpts(
-		"http://localhost:3100",
+		cfg.Loki.URL,
 		opts,
 		log.DebugLevel,
 		log.InfoLevel,
@@ -69,7 +81,7 @@ func prepareForSendingLogsToLoki(logger *log.Logger) {
 	logger.AddHook(hook)
 }
 
-func initLogger() *log.Logger {
+func initLogger(cfg *config.Config) *log.Logger {
 	logger := log.New()
 	logger.SetReportCaller(true)
 	logger.SetFormatter(&log.JSONFormatter{})
@@ -78,37 +90,151 @@ func initLogger() *log.Logger {
 
 	logger.AddHook(logrusTraceHook{})
 
-	// remover em caso nao ter loki
-	prepareForSendingLogsToLoki(logger)
+	if cfg.Loki.Enabled {
+		prepareForSendingLogsToLoki(logger, cfg)
+	}
 
 	return logger
 }
 
-func initOtelProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
-	client := otlptracehttp.NewClient(
-		otlptracehttp.WithEndpoint("localhost:4318"),
-		otlptracehttp.WithInsecure(),
-		otlptracehttp.WithURLPath("/v2/traces"),
-		otlptracehttp.WithTimeout(5*time.Second),
+func newServiceResource(cfg *config.Config) *resource.Resource {
+	serviceResources, _ := resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(cfg.App.Name),
+		),
 	)
+	return serviceResources
+}
 
-	exporter, err := otlptrace.New(ctx, client)
+func initOtelLoggerProvider(ctx context.Context, cfg *config.Config, health *healthServer) (*sdklog.LoggerProvider, error) {
+	exporterOptions := []otlploghttp.Option{
+		otlploghttp.WithEndpoint(cfg.Otlp.Endpoint),
+		otlploghttp.WithURLPath(cfg.Otlp.Logs.URLPath),
+		otlploghttp.WithTimeout(cfg.Otlp.Timeout.Duration()),
+	}
+	if cfg.Otlp.Insecure {
+		exporterOptions = append(exporterOptions, otlploghttp.WithInsecure())
+	}
+
+	exporter, err := otlploghttp.New(ctx, exporterOptions...)
 	if err != nil {
 		return nil, err
 	}
+	status := &exportStatus{}
+	health.addCheck("otlp logs", status.check)
 
-	serviceResources, _ := resource.Merge(
-		resource.Default(),
-		resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(appName),
-		),
+	provider := sdklog.NewLoggerProvider(
+		sdklog.WithResource(newServiceResource(cfg)),
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(monitoredLogExporter{exporter, status})),
 	)
 
+	return provider, nil
+}
+
+// initOtelMeterProvider builds the meter provider with the enabled readers (otlp push and/or prometheus
+// pull), it returns a nil provider when no reader is enabled
+func initOtelMeterProvider(ctx context.Context, cfg *config.Config, health *healthServer) (*sdkmetric.MeterProvider, error) {
+	options := []sdkmetric.Option{
+		sdkmetric.WithResource(newServiceResource(cfg)),
+	}
+
+	if cfg.Otlp.Metrics.Enabled {
+		exporterOptions := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(cfg.Otlp.Endpoint),
+			otlpmetrichttp.WithURLPath(cfg.Otlp.Metrics.URLPath),
+			otlpmetrichttp.WithTimeout(cfg.Otlp.Timeout.Duration()),
+		}
+		if cfg.Otlp.Insecure {
+			exporterOptions = append(exporterOptions, otlpmetrichttp.WithInsecure())
+		}
+		exporter, err := otlpmetrichttp.New(ctx, exporterOptions...)
+		if err != nil {
+			return nil, err
+		}
+		status := &exportStatus{}
+		health.addCheck("otlp metrics", status.check)
+		options = append(options, sdkmetric.WithReader(
+			sdkmetric.NewPeriodicReader(monitoredMetricExporter{exporter, status}, sdkmetric.WithInterval(cfg.Otlp.Metrics.Interval.Duration())),
+		))
+	}
+
+	if cfg.Prometheus.Enabled {
+		exporter, err := prometheus.New()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdkmetric.WithReader(exporter))
+	}
+
+	if len(options) == 1 {
+		return nil, nil
+	}
+
+	provider := sdkmetric.NewMeterProvider(options...)
+	otel.SetMeterProvider(provider)
+
+	return provider, nil
+}
+
+func startPrometheusServer(logger *log.Entry, cfg *config.Config) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Prometheus.Path, promhttp.Handler())
+	server := &http.Server{
+		Addr:              cfg.Prometheus.Address,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	logger = logger.WithFields(log.Fields{
+		"address": cfg.Prometheus.Address,
+		"path":    cfg.Prometheus.Path,
+	})
+	go func() {
+		logger.Info("Starting prometheus scrape endpoint")
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.WithError(err).Error("Prometheus scrape endpoint failed")
+		}
+	}()
+
+	return server
+}
+
+func initOtelProvider(ctx context.Context, cfg *config.Config, health *healthServer) (*sdktrace.TracerProvider, error) {
+	clientOptions := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.Otlp.Endpoint),
+		otlptracehttp.WithURLPath(cfg.Otlp.Traces.URLPath),
+		otlptracehttp.WithTimeout(cfg.Otlp.Timeout.Duration()),
+	}
+	if cfg.Otlp.Insecure {
+		clientOptions = append(clientOptions, otlptracehttp.WithInsecure())
+	}
+	client := otlptracehttp.NewClient(clientOptions...)
+
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler, err := newSampler(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &exportStatus{}
+	health.addCheck("otlp traces", status.check)
+
+	spanProcessor := sdktrace.NewBatchSpanProcessor(monitoredSpanExporter{exporter, status})
+	if cfg.Sampling.Strategy == config.SamplingRules {
+		spanProcessor = newTailSamplingProcessor(spanProcessor, cfg.Sampling.MaxBufferedTraces)
+	}
+
 	provider := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithResource(serviceResources),
-		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(newServiceResource(cfg)),
+		sdktrace.WithSpanProcessor(spanProcessor),
 	)
 
 	otel.SetTracerProvider(provider)
@@ -122,35 +248,277 @@ func initOtelProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
 	return provider, nil
 }
 
+// newDynamoDbClient builds the client shared by the repository and the idempotency store, nil when
+// neither of them uses dynamodb
+func newDynamoDbClient(ctx context.Context, logger *log.Entry, cfg *config.Config) (*dynamodb.Client, error) {
+	if cfg.Repository.Kind != config.DynamoDbRepository &&
+		(!cfg.Idempotency.Enabled || cfg.Idempotency.Store != config.DynamoDbRepository) {
+		return nil, nil
+	}
+	return db.NewDynamoDbClient(ctx, logger)
+}
+
+func newRepositoryFactory(logger *log.Entry, tracer trace.Tracer, meter metric.Meter, cfg *config.Config, client *dynamodb.Client, health *healthServer) (db.RepositoryFactory, error) {
+	var factory db.RepositoryFactory
+	switch cfg.Repository.Kind {
+	case config.DynamoDbRepository:
+		factory = db.NewDynamoDbRepositoryFactory(client, tracer, cfg.Repository.TableName)
+		health.addCheck("dynamodb "+cfg.Repository.TableName, func(ctx context.Context) error {
+			return db.CheckTable(ctx, client, cfg.Repository.TableName)
+		})
+	case config.MemoryRepository:
+		logger.Warn("Using in-memory repository, records will be lost on exit")
+		factory = db.NewMemoryRepositoryFactory(tracer, db.NewMemoryStore())
+	default:
+		return nil, fmt.Errorf("unknown repository: %s", cfg.Repository.Kind)
+	}
+
+	// metered inside the retries, so each attempt is measured
+	factory, err := db.NewMeteredRepositoryFactory(factory, meter, cfg.Repository.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.NewRetryingRepositoryFactory(factory, db.RetryPolicy{
+		MaxAttempts:    cfg.Retry.MaxAttempts,
+		InitialBackoff: cfg.Retry.InitialBackoff.Duration(),
+		MaxBackoff:     cfg.Retry.MaxBackoff.Duration(),
+		Multiplier:     cfg.Retry.Multiplier,
+		Jitter:         cfg.Retry.Jitter,
+	}), nil
+}
+
+// newIdempotencyStore returns nil when idempotency is disabled
+func newIdempotencyStore(tracer trace.Tracer, cfg *config.Config, client *dynamodb.Client, health *healthServer) (db.IdempotencyStore, error) {
+	if !cfg.Idempotency.Enabled {
+		return nil, nil
+	}
+
+	switch cfg.Idempotency.Store {
+	case config.DynamoDbRepository:
+		health.addCheck("dynamodb "+cfg.Idempotency.TableName, func(ctx context.Context) error {
+			return db.CheckTable(ctx, client, cfg.Idempotency.TableName)
+		})
+		return db.NewDynamoDbIdempotencyStore(client, tracer, cfg.Idempotency.TableName,
+			cfg.Idempotency.TTL.Duration(), cfg.Idempotency.ReservationTTL.Duration()), nil
+	case config.MemoryRepository:
+		return db.NewMemoryIdempotencyStore(cfg.Idempotency.TTL.Duration(), cfg.Idempotency.ReservationTTL.Duration()), nil
+	default:
+		return nil, fmt.Errorf("unknown idempotency store: %s", cfg.Idempotency.Store)
+	}
+}
+
+func newProcessorOptions(cfg *config.Config) messaging.ProcessorOptions {
+	return messaging.ProcessorOptions{
+		URL: cfg.Nats.URL,
+		Auth: messaging.AuthOptions{
+			Mode:         cfg.Nats.Auth.Mode,
+			Token:        cfg.Nats.Auth.Token,
+			TokenFile:    cfg.Nats.Auth.TokenFile,
+			User:         cfg.Nats.Auth.User,
+			Password:     cfg.Nats.Auth.Password,
+			NKeySeedFile: cfg.Nats.Auth.NKeySeedFile,
+			CredsFile:    cfg.Nats.Auth.CredsFile,
+		},
+		TLS: messaging.TLSOptions{
+			Enabled:            cfg.Nats.TLS.Enabled,
+			CAFile:             cfg.Nats.TLS.CAFile,
+			CertFile:           cfg.Nats.TLS.CertFile,
+			KeyFile:            cfg.Nats.TLS.KeyFile,
+			InsecureSkipVerify: cfg.Nats.TLS.InsecureSkipVerify,
+		},
+		Subjects: messaging.Subjects{
+			Create: cfg.Nats.Subjects.Create,
+			Get:    cfg.Nats.Subjects.Get,
+			List:   cfg.Nats.Subjects.List,
+			Update: cfg.Nats.Subjects.Update,
+			Delete: cfg.Nats.Subjects.Delete,
+		},
+		JetStream: messaging.JetStreamOptions{
+			Enabled:    cfg.JetStream.Enabled,
+			Stream:     cfg.JetStream.Stream,
+			Durable:    cfg.JetStream.Durable,
+			Pull:       cfg.JetStream.Pull,
+			FetchBatch: cfg.JetStream.FetchBatch,
+			FetchWait:  cfg.JetStream.FetchWait.Duration(),
+			AckWait:    cfg.JetStream.AckWait.Duration(),
+			MaxDeliver: cfg.JetStream.MaxDeliver,
+			NakDelay:   cfg.JetStream.NakDelay.Duration(),
+		},
+		DeadLetter: messaging.DeadLetterOptions{
+			Enabled:    cfg.DeadLetter.Enabled,
+			Subject:    cfg.DeadLetter.Subject,
+			Stream:     cfg.DeadLetter.Stream,
+			ReplayWait: cfg.DeadLetter.ReplayWait.Duration(),
+		},
+		Events: messaging.EventOptions{
+			Enabled: cfg.Events.Enabled,
+			Subjects: messaging.EventSubjects{
+				Created: cfg.Events.Subjects.Created,
+				Updated: cfg.Events.Subjects.Updated,
+				Deleted: cfg.Events.Subjects.Deleted,
+			},
+		},
+		Workers: messaging.WorkerOptions{
+			Workers:         cfg.Workers.Count,
+			MaxInFlight:     cfg.Workers.MaxInFlight,
+			OrderByKey:      cfg.Workers.OrderByKey,
+			PendingMessages: cfg.Workers.PendingMessages,
+			PendingBytes:    cfg.Workers.PendingBytes,
+		},
+		Reconnect: messaging.ReconnectOptions{
+			MaxAttempts: cfg.Nats.Reconnect.MaxAttempts,
+			Wait:        cfg.Nats.Reconnect.Wait.Duration(),
+			Jitter:      cfg.Nats.Reconnect.Jitter.Duration(),
+			BufferSize:  cfg.Nats.Reconnect.BufferSize,
+		},
+		DrainTimeout: cfg.Shutdown.DrainTimeout.Duration(),
+		QueueGroups: map[string]string{
+			cfg.Nats.Subjects.Create: cfg.Nats.QueueGroups.Create,
+			cfg.Nats.Subjects.Get:    cfg.Nats.QueueGroups.Get,
+			cfg.Nats.Subjects.List:   cfg.Nats.QueueGroups.List,
+			cfg.Nats.Subjects.Update: cfg.Nats.QueueGroups.Update,
+			cfg.Nats.Subjects.Delete: cfg.Nats.QueueGroups.Delete,
+		},
+	}
+}
+
 func execute() int {
 	ctx := context.Background()
 
-	logger := initLogger().WithFields(log.Fields{
-		"application":  appName,
+	cfg, args, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to load configuration. Existing!")
+		return 1
+	}
+
+	// the exporters flush what they buffered on shutdown, each within the flush timeout. The loki hook
+	// pushes every entry synchronously, it has nothing to flush.
+	flushContext := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), cfg.Shutdown.FlushTimeout.Duration())
+	}
+
+	baseLogger := initLogger(cfg)
+	logger := baseLogger.WithFields(log.Fields{
+		"application":  cfg.App.Name,
 		"execution-id": uuid.NewString(),
 	})
+
+	// the health endpoints are served while the service starts, it is ready once all the checks pass
+	health := newHealthServer(logger, cfg)
+	if cfg.HTTP.Enabled {
+		healthServer := health.start()
+		defer func() {
+			ctx, cancel := flushContext()
+			defer cancel()
+			err := healthServer.Shutdown(ctx)
+			if err != nil {
+				logger.WithError(err).Error("Error shutting down health endpoints...")
+			}
+		}()
+	}
+
+	if cfg.Otlp.Logs.Enabled {
+		loggerProvider, err := initOtelLoggerProvider(ctx, cfg, health)
+		if err != nil {
+			logger.WithError(err).Error("Failed to initialize otlp logs. Existing!")
+			return 1
+		}
+		defer func() {
+			ctx, cancel := flushContext()
+			defer cancel()
+			err := loggerProvider.Shutdown(ctx)
+			if err != nil {
+				logger.WithError(err).Error("Error shutting down otlp logs...")
+			}
+		}()
+		baseLogger.AddHook(newLogrusOtlpHook(loggerProvider, cfg.App.Name))
+	}
+
 	logger.Info("Starting up...")
 	defer logger.Info("Ending up...")
+	logger.WithField("config", cfg.Fields()).Info("Configuration loaded")
 
-	tracerProvider, err := initOtelProvider(ctx)
+	tracerProvider, err := initOtelProvider(ctx, cfg, health)
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
 	defer func() {
+		ctx, cancel := flushContext()
+		defer cancel()
 		err := tracerProvider.Shutdown(ctx)
 		if err != nil {
 			logger.WithError(err).Error("Error shutting down tracer...")
 		}
 	}()
 
-	tracer := otel.Tracer(appName)
+	meterProvider, err := initOtelMeterProvider(ctx, cfg, health)
+	if err != nil {
+		logger.WithError(err).Error("Failed to initialize metrics. Existing!")
+		return 1
+	}
+	if meterProvider != nil {
+		defer func() {
+			ctx, cancel := flushContext()
+			defer cancel()
+			err := meterProvider.Shutdown(ctx)
+			if err != nil {
+				logger.WithError(err).Error("Error shutting down metrics...")
+			}
+		}()
+	}
+	if cfg.Prometheus.Enabled {
+		prometheusServer := startPrometheusServer(logger, cfg)
+		defer func() {
+			ctx, cancel := flushContext()
+			defer cancel()
+			err := prometheusServer.Shutdown(ctx)
+			if err != nil {
+				logger.WithError(err).Error("Error shutting down prometheus scrape endpoint...")
+			}
+		}()
+	}
+
+	tracer := otel.Tracer(cfg.App.Name)
+	meter := otel.Meter(cfg.App.Name)
 
-	processor := messaging.NewNatsMessageProcessor(logger, tracer, "localhost:4222")
+	dynamoDbClient, err := newDynamoDbClient(ctx, logger, cfg)
+	if err != nil {
+		logger.WithError(err).Error("Failed to build dynamodb client. Existing!")
+		return 1
+	}
+
+	repositoryFactory, err := newRepositoryFactory(logger, tracer, meter, cfg, dynamoDbClient, health)
+	if err != nil {
+		logger.WithError(err).WithField("repository", cfg.Repository.Kind).Error("Failed to initialize repository. Existing!")
+		return 1
+	}
+
+	idempotencyStore, err := newIdempotencyStore(tracer, cfg, dynamoDbClient, health)
+	if err != nil {
+		logger.WithError(err).WithField("idempotency_store", cfg.Idempotency.Store).Error("Failed to initialize idempotency store. Existing!")
+		return 1
+	}
+
+	processor := messaging.NewNatsMessageProcessor(logger, tracer, meter, repositoryFactory, idempotencyStore, newProcessorOptions(cfg))
 	if !processor.Init() {
 		logger.Error("Failed to initialize nats message. Existing!")
 		return 1
 	}
+	health.setProcessor(processor)
+
+	if len(args) > 0 && args[0] == "replay" {
+		success := processor.ReplayDeadLetters()
+		if !processor.Shutdown() || !success {
+			logger.Error("Failed to replay dead letters. Exiting...")
+			return 1
+		}
+		return 0
+	}
 
 	if !processor.Subscribe() {
 		logger.Error("Failed to subscribe to nats messages. Existing!")
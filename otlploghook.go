@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	otellog "go.opentelemetry.io/otel/log"
+	"time"
+)
+
+// logrusOtlpHook emits every logrus entry as an OpenTelemetry log record. The trace and span ids
+// of the record are taken, by the logs SDK, from the span in the entry context.
+type logrusOtlpHook struct {
+	logger otellog.Logger
+}
+
+func newLogrusOtlpHook(provider otellog.LoggerProvider, name string) logrusOtlpHook {
+	return logrusOtlpHook{logger: provider.Logger(name)}
+}
+
+func (h logrusOtlpHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h logrusOtlpHook) Fire(entry *logrus.Entry) error {
+	ctx := entry.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	record := otellog.Record{}
+	record.SetTimestamp(entry.Time)
+	record.SetObservedTimestamp(time.Now())
+	record.SetSeverity(otlpSeverity(entry.Level))
+	record.SetSeverityText(entry.Level.String())
+	record.SetBody(otellog.StringValue(entry.Message))
+
+	attrs := make([]otellog.KeyValue, 0, len(entry.Data)+3)
+	for key, value := range entry.Data {
+		// already on the record itself
+		if key == "traceid" || key == "spanid" {
+			continue
+		}
+		attrs = append(attrs, otellog.KeyValue{Key: key, Value: otlpValue(value)})
+	}
+	if entry.HasCaller() {
+		attrs = append(attrs,
+			otellog.String("code.function", entry.Caller.Function),
+			otellog.String("code.filepath", entry.Caller.File),
+			otellog.Int("code.lineno", entry.Caller.Line),
+		)
+	}
+	record.AddAttributes(attrs...)
+
+	h.logger.Emit(ctx, record)
+	return nil
+}
+
+func otlpSeverity(level logrus.Level) otellog.Severity {
+	switch level {
+	case logrus.TraceLevel:
+		return otellog.SeverityTrace
+	case logrus.DebugLevel:
+		return otellog.SeverityDebug
+	case logrus.InfoLevel:
+		return otellog.SeverityInfo
+	case logrus.WarnLevel:
+		return otellog.SeverityWarn
+	case logrus.ErrorLevel:
+		return otellog.SeverityError
+	case logrus.FatalLevel:
+		return otellog.SeverityFatal
+	case logrus.PanicLevel:
+		// more severe than fatal
+		return otellog.SeverityFatal4
+	default:
+		return otellog.SeverityUndefined
+	}
+}
+
+func otlpValue(value any) otellog.Value {
+	switch v := value.(type) {
+	case string:
+		return otellog.StringValue(v)
+	case bool:
+		return otellog.BoolValue(v)
+	case int:
+		return otellog.IntValue(v)
+	case int32:
+		return otellog.Int64Value(int64(v))
+	case int64:
+		return otellog.Int64Value(v)
+	case uint64:
+		return otellog.Int64Value(int64(v))
+	case float64:
+		return otellog.Float64Value(v)
+	case error:
+		return otellog.StringValue(v.Error())
+	case time.Time:
+		return otellog.StringValue(v.Format(time.RFC3339Nano))
+	case fmt.Stringer:
+		return otellog.StringValue(v.String())
+	default:
+		return otellog.StringValue(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,508 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DynamoDbRepository = "dynamodb"
+	MemoryRepository   = "memory"
+)
+
+const (
+	SamplingAlways      = "always"
+	SamplingRatio       = "ratio"
+	SamplingRateLimited = "ratelimited"
+	SamplingRules       = "rules"
+)
+
+const (
+	NatsAuthNone         = "none"
+	NatsAuthToken        = "token"
+	NatsAuthUserPassword = "userpass"
+	NatsAuthNKey         = "nkey"
+	NatsAuthCreds        = "creds"
+)
+
+// Duration is a time.Duration read from text ("5s", "100ms") in config files, env vars and flags
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Config is the whole service configuration. Every leaf field can be set, by increasing precedence,
+// from the defaults, the config file (yaml or json), an env var and a command line flag. The env var
+// and flag names are derived from the yaml path: nats.subjects.create is LTT_NATS_SUBJECTS_CREATE
+// and -nats-subjects-create.
+type Config struct {
+	App         AppConfig         `yaml:"app" json:"app"`
+	Loki        LokiConfig        `yaml:"loki" json:"loki"`
+	Otlp        OtlpConfig        `yaml:"otlp" json:"otlp"`
+	Prometheus  PrometheusConfig  `yaml:"prometheus" json:"prometheus"`
+	Sampling    SamplingConfig    `yaml:"sampling" json:"sampling"`
+	Nats        NatsConfig        `yaml:"nats" json:"nats"`
+	Repository  RepositoryConfig  `yaml:"repository" json:"repository"`
+	Idempotency IdempotencyConfig `yaml:"idempotency" json:"idempotency"`
+	Retry       RetryConfig       `yaml:"retry" json:"retry"`
+	JetStream   JetStreamConfig   `yaml:"jetstream" json:"jetstream"`
+	DeadLetter  DeadLetterConfig  `yaml:"deadLetter" json:"deadLetter"`
+	Events      EventsConfig      `yaml:"events" json:"events"`
+	Workers     WorkersConfig     `yaml:"workers" json:"workers"`
+	Shutdown    ShutdownConfig    `yaml:"shutdown" json:"shutdown"`
+	HTTP        HTTPConfig        `yaml:"http" json:"http"`
+}
+
+type AppConfig struct {
+	Name string `yaml:"name" json:"name" usage:"application (service) name used on logs and traces"`
+}
+
+type LokiConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled" usage:"send logs to loki"`
+	URL     string `yaml:"url" json:"url" usage:"loki url"`
+}
+
+type OtlpConfig struct {
+	Endpoint string            `yaml:"endpoint" json:"endpoint" usage:"otlp http endpoint (host:port)"`
+	Insecure bool              `yaml:"insecure" json:"insecure" usage:"use http instead of https for otlp"`
+	Timeout  Duration          `yaml:"timeout" json:"timeout" usage:"otlp export timeout"`
+	Traces   OtlpTracesConfig  `yaml:"traces" json:"traces"`
+	Logs     OtlpLogsConfig    `yaml:"logs" json:"logs"`
+	Metrics  OtlpMetricsConfig `yaml:"metrics" json:"metrics"`
+}
+
+type OtlpTracesConfig struct {
+	URLPath string `yaml:"urlPath" json:"urlPath" usage:"otlp http traces url path"`
+}
+
+type OtlpMetricsConfig struct {
+	Enabled  bool     `yaml:"enabled" json:"enabled" usage:"export metrics over otlp"`
+	URLPath  string   `yaml:"urlPath" json:"urlPath" usage:"otlp http metrics url path"`
+	Interval Duration `yaml:"interval" json:"interval" usage:"otlp metrics export interval"`
+}
+
+type SamplingConfig struct {
+	Strategy          string  `yaml:"strategy" json:"strategy" usage:"trace sampling: always, ratio (parent based), ratelimited or rules"`
+	Ratio             float64 `yaml:"ratio" json:"ratio" usage:"sampled ratio of the traces (ratio) or of the routine traffic (rules)"`
+	TracesPerSecond   float64 `yaml:"tracesPerSecond" json:"tracesPerSecond" usage:"max sampled traces per second (ratelimited)"`
+	MaxBufferedTraces int     `yaml:"maxBufferedTraces" json:"maxBufferedTraces" usage:"max not sampled traces kept until they end, to keep the ones ending in error (rules)"`
+}
+
+type PrometheusConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled" usage:"expose a prometheus metrics scrape endpoint"`
+	Address string `yaml:"address" json:"address" usage:"listen address of the prometheus scrape endpoint"`
+	Path    string `yaml:"path" json:"path" usage:"url path of the prometheus scrape endpoint"`
+}
+
+type OtlpLogsConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled" usage:"send logs over otlp (alongside or instead of loki)"`
+	URLPath string `yaml:"urlPath" json:"urlPath" usage:"otlp http logs url path"`
+}
+
+type NatsConfig struct {
+	URL         string            `yaml:"url" json:"url" usage:"nats server url"`
+	Auth        NatsAuthConfig    `yaml:"auth" json:"auth"`
+	TLS         NatsTLSConfig     `yaml:"tls" json:"tls"`
+	Subjects    SubjectsConfig    `yaml:"subjects" json:"subjects"`
+	QueueGroups QueueGroupsConfig `yaml:"queueGroups" json:"queueGroups"`
+	Reconnect   ReconnectConfig   `yaml:"reconnect" json:"reconnect"`
+}
+
+type NatsAuthConfig struct {
+	Mode         string `yaml:"mode" json:"mode" usage:"nats authentication: none, token, userpass, nkey or creds"`
+	Token        string `yaml:"token" json:"token" usage:"nats authentication token"`
+	TokenFile    string `yaml:"tokenFile" json:"tokenFile" usage:"file with the nats authentication token (instead of the token)"`
+	User         string `yaml:"user" json:"user" usage:"nats user"`
+	Password     string `yaml:"password" json:"password" usage:"nats user password"`
+	NKeySeedFile string `yaml:"nkeySeedFile" json:"nkeySeedFile" usage:"file with the nats user nkey seed"`
+	CredsFile    string `yaml:"credsFile" json:"credsFile" usage:"nats user JWT .creds file"`
+}
+
+type NatsTLSConfig struct {
+	Enabled            bool   `yaml:"enabled" json:"enabled" usage:"connect to nats with TLS"`
+	CAFile             string `yaml:"caFile" json:"caFile" usage:"CA of the nats server certificate, the system CAs when empty"`
+	CertFile           string `yaml:"certFile" json:"certFile" usage:"client certificate (mTLS)"`
+	KeyFile            string `yaml:"keyFile" json:"keyFile" usage:"client certificate key (mTLS)"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify" json:"insecureSkipVerify" usage:"do not verify the nats server certificate"`
+}
+
+type SubjectsConfig struct {
+	Create string `yaml:"create" json:"create" usage:"subject of the create record messages"`
+	Get    string `yaml:"get" json:"get" usage:"subject of the get record messages"`
+	List   string `yaml:"list" json:"list" usage:"subject of the list records messages"`
+	Update string `yaml:"update" json:"update" usage:"subject of the update record messages"`
+	Delete string `yaml:"delete" json:"delete" usage:"subject of the delete record messages"`
+}
+
+type QueueGroupsConfig struct {
+	Create string `yaml:"create" json:"create" usage:"queue group of the create subject, empty for a plain subscription"`
+	Get    string `yaml:"get" json:"get" usage:"queue group of the get subject, empty for a plain subscription"`
+	List   string `yaml:"list" json:"list" usage:"queue group of the list subject, empty for a plain subscription"`
+	Update string `yaml:"update" json:"update" usage:"queue group of the update subject, empty for a plain subscription"`
+	Delete string `yaml:"delete" json:"delete" usage:"queue group of the delete subject, empty for a plain subscription"`
+}
+
+type ReconnectConfig struct {
+	MaxAttempts int      `yaml:"maxAttempts" json:"maxAttempts" usage:"max nats reconnect attempts before the connection is closed (-1 for no limit)"`
+	Wait        Duration `yaml:"wait" json:"wait" usage:"wait between nats reconnect attempts"`
+	Jitter      Duration `yaml:"jitter" json:"jitter" usage:"max random delay added to the reconnect wait"`
+	BufferSize  int      `yaml:"bufferSize" json:"bufferSize" usage:"bytes published while reconnecting kept until reconnected (-1 to fail the publishes)"`
+}
+
+type RepositoryConfig struct {
+	Kind      string `yaml:"kind" json:"kind" usage:"records repository: dynamodb or memory"`
+	TableName string `yaml:"tableName" json:"tableName" usage:"dynamodb table name"`
+}
+
+type IdempotencyConfig struct {
+	Enabled   bool     `yaml:"enabled" json:"enabled" usage:"reply the stored response to the messages already processed (Nats-Msg-Id or idempotency-key header)"`
+	Store     string   `yaml:"store" json:"store" usage:"idempotency store: dynamodb or memory"`
+	TableName string   `yaml:"tableName" json:"tableName" usage:"dynamodb idempotency table name"`
+	TTL       Duration `yaml:"ttl" json:"ttl" usage:"how long the responses are kept"`
+	// longer than the processing of a message, a reservation left by a crashed instance blocks its key until then
+	ReservationTTL Duration `yaml:"reservationTtl" json:"reservationTtl" usage:"how long a message being processed holds its idempotency key"`
+}
+
+type RetryConfig struct {
+	MaxAttempts    int      `yaml:"maxAttempts" json:"maxAttempts" usage:"max attempts of a repository operation"`
+	InitialBackoff Duration `yaml:"initialBackoff" json:"initialBackoff" usage:"backoff after the first failed repository attempt"`
+	MaxBackoff     Duration `yaml:"maxBackoff" json:"maxBackoff" usage:"max backoff between repository attempts"`
+	Multiplier     float64  `yaml:"multiplier" json:"multiplier" usage:"backoff multiplier between repository attempts"`
+	Jitter         float64  `yaml:"jitter" json:"jitter" usage:"fraction of the backoff randomly added or removed (0 to 1)"`
+}
+
+type JetStreamConfig struct {
+	Enabled    bool     `yaml:"enabled" json:"enabled" usage:"consume messages from durable JetStream consumers"`
+	Stream     string   `yaml:"stream" json:"stream" usage:"JetStream stream capturing the subjects"`
+	Durable    string   `yaml:"durable" json:"durable" usage:"prefix of the durable consumer names"`
+	Pull       bool     `yaml:"pull" json:"pull" usage:"use pull (true) or push (false) JetStream consumers"`
+	FetchBatch int      `yaml:"fetchBatch" json:"fetchBatch" usage:"messages fetched at once by pull consumers"`
+	FetchWait  Duration `yaml:"fetchWait" json:"fetchWait" usage:"max wait of a pull consumer fetch"`
+	AckWait    Duration `yaml:"ackWait" json:"ackWait" usage:"time to ack a message before it is redelivered"`
+	MaxDeliver int      `yaml:"maxDeliver" json:"maxDeliver" usage:"max deliveries of a message"`
+	NakDelay   Duration `yaml:"nakDelay" json:"nakDelay" usage:"redelivery delay of a message that failed on the repository or duplicates one being processed"`
+}
+
+type DeadLetterConfig struct {
+	Enabled    bool     `yaml:"enabled" json:"enabled" usage:"republish failed messages to the dead letter subject"`
+	Subject    string   `yaml:"subject" json:"subject" usage:"dead letter subject"`
+	Stream     string   `yaml:"stream" json:"stream" usage:"JetStream stream keeping the dead letters until replayed (requires JetStream), empty to not keep them"`
+	ReplayWait Duration `yaml:"replayWait" json:"replayWait" usage:"how long the replay waits for more dead letters"`
+}
+
+type EventsConfig struct {
+	Enabled  bool                `yaml:"enabled" json:"enabled" usage:"publish an event after each record write"`
+	Subjects EventSubjectsConfig `yaml:"subjects" json:"subjects"`
+}
+
+type EventSubjectsConfig struct {
+	Created string `yaml:"created" json:"created" usage:"subject of the record created events"`
+	Updated string `yaml:"updated" json:"updated" usage:"subject of the record updated events"`
+	Deleted string `yaml:"deleted" json:"deleted" usage:"subject of the record deleted events"`
+}
+
+type WorkersConfig struct {
+	Count           int  `yaml:"count" json:"count" usage:"workers processing the messages of each subject"`
+	MaxInFlight     int  `yaml:"maxInFlight" json:"maxInFlight" usage:"max messages queued or processed per subject, the deliveries wait above it"`
+	OrderByKey      bool `yaml:"orderByKey" json:"orderByKey" usage:"process the messages of the same namespace and key in order"`
+	PendingMessages int  `yaml:"pendingMessages" json:"pendingMessages" usage:"max messages buffered by a subscription, dropped above it (-1 for no limit)"`
+	PendingBytes    int  `yaml:"pendingBytes" json:"pendingBytes" usage:"max bytes buffered by a subscription, dropped above it (-1 for no limit)"`
+}
+
+type ShutdownConfig struct {
+	DrainTimeout Duration `yaml:"drainTimeout" json:"drainTimeout" usage:"max wait on shutdown for the received messages to be processed"`
+	FlushTimeout Duration `yaml:"flushTimeout" json:"flushTimeout" usage:"max wait on shutdown of each exporter (spans, logs, metrics) to flush"`
+}
+
+type HTTPConfig struct {
+	Enabled          bool     `yaml:"enabled" json:"enabled" usage:"serve the /healthz and /readyz probes"`
+	Address          string   `yaml:"address" json:"address" usage:"listen address of the health endpoints"`
+	Debug            bool     `yaml:"debug" json:"debug" usage:"serve the /debug diagnostics (subscriptions, connection, build)"`
+	ReadinessTimeout Duration `yaml:"readinessTimeout" json:"readinessTimeout" usage:"max duration of the /readyz checks"`
+}
+
+func Default() *Config {
+	return &Config{
+		App: AppConfig{
+			Name: "my-test-application",
+		},
+		Loki: LokiConfig{
+			Enabled: true,
+			URL:     "http://localhost:3100",
+		},
+		Otlp: OtlpConfig{
+			Endpoint: "localhost:4318",
+			Insecure: true,
+			Timeout:  Duration(5 * time.Second),
+			Traces: OtlpTracesConfig{
+				URLPath: "/v2/traces",
+			},
+			Logs: OtlpLogsConfig{
+				Enabled: false,
+				URLPath: "/v1/logs",
+			},
+			Metrics: OtlpMetricsConfig{
+				Enabled:  false,
+				URLPath:  "/v1/metrics",
+				Interval: Duration(15 * time.Second),
+			},
+		},
+		Prometheus: PrometheusConfig{
+			Enabled: false,
+			Address: ":9464",
+			Path:    "/metrics",
+		},
+		Sampling: SamplingConfig{
+			Strategy:          SamplingAlways,
+			Ratio:             0.1,
+			TracesPerSecond:   10,
+			MaxBufferedTraces: 1000,
+		},
+		Nats: NatsConfig{
+			URL: "localhost:4222",
+			Auth: NatsAuthConfig{
+				Mode: NatsAuthNone,
+			},
+			Subjects: SubjectsConfig{
+				Create: "create",
+				Get:    "get",
+				List:   "list",
+				Update: "update",
+				Delete: "delete",
+			},
+			QueueGroups: QueueGroupsConfig{
+				Create: "records-processor",
+				Get:    "records-processor",
+				List:   "records-processor",
+				Update: "records-processor",
+				Delete: "records-processor",
+			},
+			Reconnect: ReconnectConfig{
+				MaxAttempts: 60,
+				Wait:        Duration(2 * time.Second),
+				Jitter:      Duration(100 * time.Millisecond),
+				BufferSize:  8 * 1024 * 1024,
+			},
+		},
+		Repository: RepositoryConfig{
+			Kind:      DynamoDbRepository,
+			TableName: "my-table",
+		},
+		Idempotency: IdempotencyConfig{
+			Enabled:        true,
+			Store:          MemoryRepository,
+			TableName:      "my-idempotency",
+			TTL:            Duration(time.Hour),
+			ReservationTTL: Duration(time.Minute),
+		},
+		Retry: RetryConfig{
+			MaxAttempts:    3,
+			InitialBackoff: Duration(100 * time.Millisecond),
+			MaxBackoff:     Duration(2 * time.Second),
+			Multiplier:     2,
+			Jitter:         0.2,
+		},
+		JetStream: JetStreamConfig{
+			Enabled:    false,
+			Stream:     "RECORDS",
+			Durable:    "records-processor",
+			Pull:       true,
+			FetchBatch: 10,
+			FetchWait:  Duration(5 * time.Second),
+			AckWait:    Duration(30 * time.Second),
+			MaxDeliver: 5,
+			NakDelay:   Duration(5 * time.Second),
+		},
+		DeadLetter: DeadLetterConfig{
+			Enabled:    true,
+			Subject:    "dead-letter",
+			Stream:     "",
+			ReplayWait: Duration(2 * time.Second),
+		},
+		Events: EventsConfig{
+			Enabled: true,
+			Subjects: EventSubjectsConfig{
+				Created: "record.created",
+				Updated: "record.updated",
+				Deleted: "record.deleted",
+			},
+		},
+		Workers: WorkersConfig{
+			Count:           4,
+			MaxInFlight:     100,
+			OrderByKey:      false,
+			PendingMessages: 1000,
+			PendingBytes:    64 * 1024 * 1024,
+		},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: Duration(30 * time.Second),
+			FlushTimeout: Duration(5 * time.Second),
+		},
+		HTTP: HTTPConfig{
+			Enabled:          true,
+			Address:          ":8080",
+			Debug:            true,
+			ReadinessTimeout: Duration(2 * time.Second),
+		},
+	}
+}
+
+// Validate checks the whole configuration and reports every problem found at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.App.Name != "", "app.name is required")
+	check(!c.Loki.Enabled || c.Loki.URL != "", "loki.url is required when loki is enabled")
+	check(c.Otlp.Endpoint != "", "otlp.endpoint is required")
+	check(c.Otlp.Timeout > 0, "otlp.timeout must be positive")
+	check(!c.Otlp.Logs.Enabled || c.Otlp.Logs.URLPath != "", "otlp.logs.urlPath is required when otlp logs are enabled")
+	check(!c.Otlp.Metrics.Enabled || c.Otlp.Metrics.URLPath != "", "otlp.metrics.urlPath is required when otlp metrics are enabled")
+	check(!c.Otlp.Metrics.Enabled || c.Otlp.Metrics.Interval > 0, "otlp.metrics.interval must be positive")
+	check(!c.Prometheus.Enabled || c.Prometheus.Address != "", "prometheus.address is required when prometheus is enabled")
+	check(!c.Prometheus.Enabled || strings.HasPrefix(c.Prometheus.Path, "/"), "prometheus.path must start with /")
+	switch c.Sampling.Strategy {
+	case SamplingAlways:
+	case SamplingRatio, SamplingRules:
+		check(c.Sampling.Ratio >= 0 && c.Sampling.Ratio <= 1, "sampling.ratio must be between 0 and 1")
+		check(c.Sampling.Strategy != SamplingRules || c.Sampling.MaxBufferedTraces >= 1, "sampling.maxBufferedTraces must be at least 1")
+	case SamplingRateLimited:
+		check(c.Sampling.TracesPerSecond > 0, "sampling.tracesPerSecond must be positive")
+	default:
+		check(false, "sampling.strategy must be %s, %s, %s or %s, got %q",
+			SamplingAlways, SamplingRatio, SamplingRateLimited, SamplingRules, c.Sampling.Strategy)
+	}
+
+	check(c.Nats.URL != "", "nats.url is required")
+	switch c.Nats.Auth.Mode {
+	case NatsAuthNone:
+	case NatsAuthToken:
+		check(c.Nats.Auth.Token != "" || c.Nats.Auth.TokenFile != "", "nats.auth.token or nats.auth.tokenFile is required for token authentication")
+	case NatsAuthUserPassword:
+		check(c.Nats.Auth.User != "", "nats.auth.user is required for userpass authentication")
+	case NatsAuthNKey:
+		check(c.Nats.Auth.NKeySeedFile != "", "nats.auth.nkeySeedFile is required for nkey authentication")
+	case NatsAuthCreds:
+		check(c.Nats.Auth.CredsFile != "", "nats.auth.credsFile is required for creds authentication")
+	default:
+		check(false, "nats.auth.mode must be %s, %s, %s, %s or %s, got %q",
+			NatsAuthNone, NatsAuthToken, NatsAuthUserPassword, NatsAuthNKey, NatsAuthCreds, c.Nats.Auth.Mode)
+	}
+	check((c.Nats.TLS.CertFile == "") == (c.Nats.TLS.KeyFile == ""), "nats.tls.certFile and nats.tls.keyFile must be set together")
+	check(c.Nats.TLS.Enabled || (c.Nats.TLS.CAFile == "" && c.Nats.TLS.CertFile == ""), "nats.tls.enabled is required to use the nats tls files")
+
+	subjects := map[string]bool{}
+	for _, subject := range []struct{ name, value string }{
+		{"create", c.Nats.Subjects.Create},
+		{"get", c.Nats.Subjects.Get},
+		{"list", c.Nats.Subjects.List},
+		{"update", c.Nats.Subjects.Update},
+		{"delete", c.Nats.Subjects.Delete},
+	} {
+		check(subject.value != "", "nats.subjects.%s is required", subject.name)
+		check(!subjects[subject.value], "nats.subjects.%s duplicates subject %q", subject.name, subject.value)
+		subjects[subject.value] = true
+	}
+
+	for _, group := range []struct{ name, value string }{
+		{"create", c.Nats.QueueGroups.Create},
+		{"get", c.Nats.QueueGroups.Get},
+		{"list", c.Nats.QueueGroups.List},
+		{"update", c.Nats.QueueGroups.Update},
+		{"delete", c.Nats.QueueGroups.Delete},
+	} {
+		check(!strings.ContainsAny(group.value, " \t\r\n"), "nats.queueGroups.%s must not contain whitespace", group.name)
+	}
+
+	check(c.Nats.Reconnect.MaxAttempts >= -1, "nats.reconnect.maxAttempts must be positive, 0 or -1")
+	check(c.Nats.Reconnect.Wait >= 0, "nats.reconnect.wait must not be negative")
+	check(c.Nats.Reconnect.Jitter >= 0, "nats.reconnect.jitter must not be negative")
+	check(c.Nats.Reconnect.BufferSize != 0 && c.Nats.Reconnect.BufferSize >= -1, "nats.reconnect.bufferSize must be positive or -1")
+
+	check(c.Repository.Kind == DynamoDbRepository || c.Repository.Kind == MemoryRepository,
+		"repository.kind must be %s or %s, got %q", DynamoDbRepository, MemoryRepository, c.Repository.Kind)
+	check(c.Repository.Kind != DynamoDbRepository || c.Repository.TableName != "",
+		"repository.tableName is required for the %s repository", DynamoDbRepository)
+
+	if c.Idempotency.Enabled {
+		check(c.Idempotency.Store == DynamoDbRepository || c.Idempotency.Store == MemoryRepository,
+			"idempotency.store must be %s or %s, got %q", DynamoDbRepository, MemoryRepository, c.Idempotency.Store)
+		check(c.Idempotency.Store != DynamoDbRepository || c.Idempotency.TableName != "",
+			"idempotency.tableName is required for the %s store", DynamoDbRepository)
+		check(c.Idempotency.TTL > 0, "idempotency.ttl must be positive")
+		check(c.Idempotency.ReservationTTL > 0, "idempotency.reservationTtl must be positive")
+	}
+
+	check(c.Retry.MaxAttempts >= 1, "retry.maxAttempts must be at least 1")
+	check(c.Retry.InitialBackoff >= 0, "retry.initialBackoff must not be negative")
+	check(c.Retry.MaxBackoff >= c.Retry.InitialBackoff, "retry.maxBackoff must not be lower than retry.initialBackoff")
+	check(c.Retry.Multiplier >= 1, "retry.multiplier must be at least 1")
+	check(c.Retry.Jitter >= 0 && c.Retry.Jitter <= 1, "retry.jitter must be between 0 and 1")
+
+	if c.JetStream.Enabled {
+		check(c.JetStream.Stream != "", "jetstream.stream is required")
+		check(c.JetStream.Durable != "", "jetstream.durable is required")
+		check(c.JetStream.FetchBatch >= 1, "jetstream.fetchBatch must be at least 1")
+		check(c.JetStream.FetchWait > 0, "jetstream.fetchWait must be positive")
+		check(c.JetStream.AckWait > 0, "jetstream.ackWait must be positive")
+		check(c.JetStream.MaxDeliver >= 1, "jetstream.maxDeliver must be at least 1")
+		check(c.JetStream.NakDelay >= 0, "jetstream.nakDelay must not be negative")
+	}
+
+	check(c.Workers.Count >= 1, "workers.count must be at least 1")
+	check(c.Workers.MaxInFlight >= c.Workers.Count, "workers.maxInFlight must not be lower than workers.count")
+	check(c.Workers.PendingMessages != 0 && c.Workers.PendingMessages >= -1, "workers.pendingMessages must be positive or -1")
+	check(c.Workers.PendingBytes != 0 && c.Workers.PendingBytes >= -1, "workers.pendingBytes must be positive or -1")
+
+	if c.HTTP.Enabled {
+		check(c.HTTP.Address != "", "http.address is required when http is enabled")
+		check(c.HTTP.ReadinessTimeout > 0, "http.readinessTimeout must be positive")
+		check(!c.Prometheus.Enabled || c.HTTP.Address != c.Prometheus.Address, "http.address must not be the prometheus address")
+	}
+
+	check(c.Shutdown.DrainTimeout > 0, "shutdown.drainTimeout must be positive")
+	check(c.Shutdown.FlushTimeout > 0, "shutdown.flushTimeout must be positive")
+
+	if c.DeadLetter.Enabled {
+		check(c.DeadLetter.Subject != "", "deadLetter.subject is required")
+		check(!subjects[c.DeadLetter.Subject], "deadLetter.subject must not be one of the processed subjects")
+		check(c.DeadLetter.ReplayWait > 0, "deadLetter.replayWait must be positive")
+	}
+
+	if c.Events.Enabled {
+		for _, subject := range []struct{ name, value string }{
+			{"created", c.Events.Subjects.Created},
+			{"updated", c.Events.Subjects.Updated},
+			{"deleted", c.Events.Subjects.Deleted},
+		} {
+			check(subject.value != "", "events.subjects.%s is required", subject.name)
+			check(!subjects[subject.value], "events.subjects.%s must not be one of the processed subjects", subject.name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
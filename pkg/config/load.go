@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	envPrefix      = "LTT_"
+	configFileFlag = "config"
+	configFileEnv  = envPrefix + "CONFIG"
+)
+
+// setting is a leaf of the configuration, bound to the field it sets
+type setting struct {
+	path  string
+	env   string
+	flag  string
+	usage string
+	value reflect.Value
+}
+
+// Set parses the text into the bound field, setting implements flag.Value
+func (s *setting) Set(text string) error {
+	if unmarshaler, ok := s.value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(text))
+	}
+
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+	return nil
+}
+
+func (s *setting) String() string {
+	if !s.value.IsValid() {
+		return ""
+	}
+	if stringer, ok := s.value.Interface().(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprint(s.value.Interface())
+}
+
+func (s *setting) IsBoolFlag() bool {
+	return s.value.IsValid() && s.value.Kind() == reflect.Bool
+}
+
+// settings walks the configuration struct and returns one setting per leaf field
+func (c *Config) settings() []*setting {
+	var settings []*setting
+	var walk func(value reflect.Value, path []string)
+	walk = func(value reflect.Value, path []string) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			fieldPath := append(append([]string{}, path...), name)
+			fieldValue := value.Field(i)
+
+			_, isText := fieldValue.Addr().Interface().(encoding.TextUnmarshaler)
+			if fieldValue.Kind() == reflect.Struct && !isText {
+				walk(fieldValue, fieldPath)
+				continue
+			}
+
+			words := make([]string, 0, len(fieldPath))
+			for _, part := range fieldPath {
+				words = append(words, splitCamelCase(part)...)
+			}
+			settings = append(settings, &setting{
+				path:  strings.Join(fieldPath, "."),
+				env:   envPrefix + strings.ToUpper(strings.Join(words, "_")),
+				flag:  strings.Join(words, "-"),
+				usage: field.Tag.Get("usage"),
+				value: fieldValue,
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), nil)
+	return settings
+}
+
+func splitCamelCase(name string) []string {
+	var words []string
+	var word []rune
+	runes := []rune(name)
+	for i, r := range runes {
+		// a new word starts on an upper case letter following a lower case one (urlPath -> url, path)
+		// or ending an acronym (URLPath -> url, path)
+		if unicode.IsUpper(r) && len(word) > 0 &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			words = append(words, string(word))
+			word = nil
+		}
+		word = append(word, unicode.ToLower(r))
+	}
+	return append(words, string(word))
+}
+
+// Load builds the configuration from, by increasing precedence, the defaults, the config file given by
+// the -config flag (or LTT_CONFIG env var), the env vars and the command line flags, and validates it.
+// The returned args are the positional command line arguments.
+func Load(name string, args []string) (*Config, []string, error) {
+	config := Default()
+	settings := config.settings()
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String(configFileFlag, os.Getenv(configFileEnv), "yaml or json configuration file")
+	for _, s := range settings {
+		flags.Var(s, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// flags were written on the defaults, keep them to apply them again on top of the file and env vars
+	setFlags := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	if *configFile != "" {
+		err = config.loadFile(*configFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load config file %s: %w", *configFile, err)
+		}
+	}
+
+	for _, s := range settings {
+		value, found := os.LookupEnv(s.env)
+		if !found {
+			continue
+		}
+		err = s.Set(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value %q of env var %s: %w", value, s.env, err)
+		}
+	}
+
+	for _, s := range settings {
+		value, found := setFlags[s.flag]
+		if !found {
+			continue
+		}
+		err = s.Set(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value %q of flag -%s: %w", value, s.flag, err)
+		}
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return config, flags.Args(), nil
+}
+
+// loadFile reads a yaml or json (by extension) config file, unknown fields are rejected
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(c)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	return decoder.Decode(c)
+}
+
+// Fields lists the effective configuration, by yaml path, with the secrets masked
+func (c *Config) Fields() map[string]any {
+	fields := map[string]any{}
+	for _, s := range c.settings() {
+		value := s.String()
+		if isSecret(s.path) && value != "" {
+			value = "*****"
+		}
+		fields[s.path] = value
+	}
+	return fields
+}
+
+func isSecret(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasSuffix(lower, "token") || strings.HasSuffix(lower, "password") || strings.HasSuffix(lower, "seed")
+}
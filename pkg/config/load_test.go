@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfigFile(t, "config.yaml", "nats:\n  url: file:4222\nworkers:\n  count: 2\n")
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		wantURL     string
+		wantWorkers int
+	}{
+		{name: "defaults", wantURL: "localhost:4222", wantWorkers: 4},
+		{name: "file", args: []string{"-config", file}, wantURL: "file:4222", wantWorkers: 2},
+		{name: "file from env", env: map[string]string{"LTT_CONFIG": file}, wantURL: "file:4222", wantWorkers: 2},
+		{name: "env over file", env: map[string]string{"LTT_NATS_URL": "env:4222"}, args: []string{"-config", file},
+			wantURL: "env:4222", wantWorkers: 2},
+		{name: "flag over env and file", env: map[string]string{"LTT_NATS_URL": "env:4222", "LTT_WORKERS_COUNT": "8"},
+			args: []string{"-config", file, "-nats-url", "flag:4222"}, wantURL: "flag:4222", wantWorkers: 8},
+		{name: "flag with the default value over env", env: map[string]string{"LTT_WORKERS_COUNT": "8"},
+			args: []string{"-workers-count", "4"}, wantURL: "localhost:4222", wantWorkers: 4},
+		{name: "flag before the config flag", args: []string{"-workers-count", "6", "-config", file},
+			wantURL: "file:4222", wantWorkers: 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			config, _, err := Load("test", test.args)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if config.Nats.URL != test.wantURL || config.Workers.Count != test.wantWorkers {
+				t.Errorf("got url %q and %d workers, want url %q and %d workers",
+					config.Nats.URL, config.Workers.Count, test.wantURL, test.wantWorkers)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{name: "missing file", args: []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}},
+		{name: "unknown file field", args: []string{"-config", writeConfigFile(t, "unknown.yaml", "nats:\n  address: x\n")}},
+		{name: "unknown json field", args: []string{"-config", writeConfigFile(t, "unknown.json", `{"nats":{"address":"x"}}`)}},
+		{name: "invalid env value", env: map[string]string{"LTT_WORKERS_COUNT": "many"}},
+		{name: "invalid flag value", args: []string{"-shutdown-drain-timeout", "soon"}},
+		{name: "unknown flag", args: []string{"-unknown"}},
+		{name: "invalid configuration", env: map[string]string{"LTT_NATS_AUTH_MODE": "token"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			if _, _, err := Load("test", test.args); err == nil {
+				t.Error("configuration accepted")
+			}
+		})
+	}
+}
+
+func TestLoadPositionalArgs(t *testing.T) {
+	_, args, err := Load("test", []string{"-workers-count", "2", "replay"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(args) != 1 || args[0] != "replay" {
+		t.Errorf("got args %v, want [replay]", args)
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	_, _, err := Load("test", []string{"-config", filepath.Join("..", "..", "config.example.yaml")})
+	if err != nil {
+		t.Errorf("config.example.yaml: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// the continuation token handed to callers is opaque: the last evaluated key of a query
+// (only string attributes, as all the table keys are strings) encoded as base64 json
+
+func encodeCursor(lastEvaluatedKey map[string]types.AttributeValue) (string, error) {
+	if len(lastEvaluatedKey) == 0 {
+		return "", nil
+	}
+
+	values := make(map[string]string, len(lastEvaluatedKey))
+	for name, value := range lastEvaluatedKey {
+		s, ok := value.(*types.AttributeValueMemberS)
+		if !ok {
+			return "", fmt.Errorf("unsupported key attribute type for %s", name)
+		}
+		values[name] = s.Value
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor only accepts a cursor of the listed namespace and key prefix: a tampered or foreign one
+// would be rejected by dynamodb as a repository failure
+func decodeCursor(cursor string, namespace string, prefix string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	values := map[string]string{}
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+
+	if len(values) != 2 {
+		return nil, fmt.Errorf("%w: unexpected attributes", ErrInvalidCursor)
+	}
+	if cursorNamespace, ok := values["namespace"]; !ok || cursorNamespace != namespace {
+		return nil, fmt.Errorf("%w: not a cursor of namespace %s", ErrInvalidCursor, namespace)
+	}
+	if cursorKey, ok := values["key"]; !ok || !strings.HasPrefix(cursorKey, prefix) {
+		return nil, fmt.Errorf("%w: not a cursor of key prefix %q", ErrInvalidCursor, prefix)
+	}
+
+	startKey := make(map[string]types.AttributeValue, len(values))
+	for name, value := range values {
+		startKey[name] = &types.AttributeValueMemberS{Value: value}
+	}
+	return startKey, nil
+}
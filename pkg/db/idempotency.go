@@ -0,0 +1,252 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrIdempotencyKeyInProgress is returned by Reserve when another message holds the key
+	ErrIdempotencyKeyInProgress = errors.New("a message with the same idempotency key is being processed")
+	// ErrIdempotencyReservationLost is returned by Complete when the reservation expired and was taken over
+	ErrIdempotencyReservationLost = errors.New("idempotency key no longer reserved")
+)
+
+// IdempotencyStore keeps the responses of the processed messages by idempotency key, for a limited time.
+// The key is reserved before its message is processed, so that concurrent duplicates are not processed
+// twice. Each reservation is identified by a token, it expires if it is neither completed nor released.
+type IdempotencyStore interface {
+	// Reserve claims the key for token. It returns the response of an already processed message,
+	// ErrIdempotencyKeyInProgress when another reservation holds the key, or nil when reserved.
+	Reserve(ctx context.Context, key string, token string) ([]byte, error)
+	// Complete saves the response, only if the key is still reserved for token
+	Complete(ctx context.Context, key string, token string, response []byte) error
+	// Release drops the reservation of token, the key can be reserved again
+	Release(ctx context.Context, key string, token string) error
+}
+
+type idempotencyItem struct {
+	Key      string `dynamodbav:"id"`
+	Token    string `dynamodbav:"token"`
+	Response []byte `dynamodbav:"response"`
+	// epoch seconds, the table TTL attribute
+	ExpiresAt int64 `dynamodbav:"expiresAt"`
+}
+
+// DynamoDbIdempotencyStore keeps the responses in a table with the id hash key and expiresAt as TTL attribute
+type DynamoDbIdempotencyStore struct {
+	tracer         trace.Tracer
+	client         *dynamodb.Client
+	tableName      string
+	ttl            time.Duration
+	reservationTTL time.Duration
+}
+
+func NewDynamoDbIdempotencyStore(client *dynamodb.Client, tracer trace.Tracer, tableName string, ttl time.Duration, reservationTTL time.Duration) *DynamoDbIdempotencyStore {
+	return &DynamoDbIdempotencyStore{
+		tracer:         tracer,
+		client:         client,
+		tableName:      tableName,
+		ttl:            ttl,
+		reservationTTL: reservationTTL,
+	}
+}
+
+func epochValue(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+// Reserve puts the reservation unless the key holds an item not yet expired, the expired items are
+// only deleted eventually by DynamoDB
+func (d *DynamoDbIdempotencyStore) Reserve(ctx context.Context, key string, token string) ([]byte, error) {
+	ctx, span := d.tracer.Start(ctx,
+		"Reserve idempotency key",
+		trace.WithAttributes(attribute.String("idempotency_key", key)),
+	)
+	defer span.End()
+
+	now := time.Now()
+	expr, err := expression.NewBuilder().WithCondition(expression.Or(
+		expression.AttributeNotExists(expression.Name("id")),
+		expression.Name("expiresAt").LessThanEqual(expression.Value(now.Unix())),
+	)).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item: map[string]types.AttributeValue{
+			"id":        &types.AttributeValueMemberS{Value: key},
+			"token":     &types.AttributeValueMemberS{Value: token},
+			"expiresAt": epochValue(now.Add(d.reservationTTL)),
+		},
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ConditionExpression:                 expr.Condition(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return nil, err
+	}
+
+	item := idempotencyItem{}
+	err = attributevalue.UnmarshalMap(conditionErr.Item, &item)
+	if err != nil {
+		return nil, err
+	}
+	if item.Response == nil {
+		span.SetAttributes(attribute.Bool("in_progress", true))
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	span.SetAttributes(attribute.Bool("found", true))
+	return item.Response, nil
+}
+
+func (d *DynamoDbIdempotencyStore) Complete(ctx context.Context, key string, token string, response []byte) error {
+	ctx, span := d.tracer.Start(ctx,
+		"Save idempotency record",
+		trace.WithAttributes(attribute.String("idempotency_key", key)),
+	)
+	defer span.End()
+
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("token").Equal(expression.Value(token))).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item: map[string]types.AttributeValue{
+			"id":        &types.AttributeValueMemberS{Value: key},
+			"token":     &types.AttributeValueMemberS{Value: token},
+			"response":  &types.AttributeValueMemberB{Value: response},
+			"expiresAt": epochValue(time.Now().Add(d.ttl)),
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrIdempotencyReservationLost
+	}
+	return err
+}
+
+// Release deletes the reservation, a reservation already taken over is left untouched
+func (d *DynamoDbIdempotencyStore) Release(ctx context.Context, key string, token string) error {
+	ctx, span := d.tracer.Start(ctx,
+		"Release idempotency key",
+		trace.WithAttributes(attribute.String("idempotency_key", key)),
+	)
+	defer span.End()
+
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("token").Equal(expression.Value(token))).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: key},
+		},
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConditionExpression:       expr.Condition(),
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil
+	}
+	return err
+}
+
+type memoryIdempotencyEntry struct {
+	token string
+	// nil while the message is processed
+	response  []byte
+	expiresAt time.Time
+}
+
+// MemoryIdempotencyStore keeps the responses in the process memory, the expired ones are swept on reservations
+type MemoryIdempotencyStore struct {
+	mutex          sync.Mutex
+	ttl            time.Duration
+	reservationTTL time.Duration
+	entries        map[string]memoryIdempotencyEntry
+	lastSweep      time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration, reservationTTL time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:            ttl,
+		reservationTTL: reservationTTL,
+		entries:        map[string]memoryIdempotencyEntry{},
+		lastSweep:      time.Now(),
+	}
+}
+
+func (m *MemoryIdempotencyStore) Reserve(_ context.Context, key string, token string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > time.Minute {
+		for entryKey, entry := range m.entries {
+			if now.After(entry.expiresAt) {
+				delete(m.entries, entryKey)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	entry, found := m.entries[key]
+	if found && !now.After(entry.expiresAt) {
+		if entry.response == nil {
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		return entry.response, nil
+	}
+	m.entries[key] = memoryIdempotencyEntry{token: token, expiresAt: now.Add(m.reservationTTL)}
+	return nil, nil
+}
+
+func (m *MemoryIdempotencyStore) Complete(_ context.Context, key string, token string, response []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, found := m.entries[key]
+	if !found || entry.token != token {
+		return ErrIdempotencyReservationLost
+	}
+	m.entries[key] = memoryIdempotencyEntry{token: token, response: response, expiresAt: time.Now().Add(m.ttl)}
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Release(_ context.Context, key string, token string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, found := m.entries[key]
+	if found && entry.token == token {
+		delete(m.entries, key)
+	}
+	return nil
+}
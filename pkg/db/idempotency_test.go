@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name         string
+		steps        func(store *MemoryIdempotencyStore) error
+		wantResponse string
+		wantErr      error
+	}{
+		{
+			name:  "unknown key",
+			steps: func(*MemoryIdempotencyStore) error { return nil },
+		},
+		{
+			name: "in progress",
+			steps: func(store *MemoryIdempotencyStore) error {
+				_, err := store.Reserve(ctx, "key", "first")
+				return err
+			},
+			wantErr: ErrIdempotencyKeyInProgress,
+		},
+		{
+			name: "completed",
+			steps: func(store *MemoryIdempotencyStore) error {
+				_, err := store.Reserve(ctx, "key", "first")
+				if err != nil {
+					return err
+				}
+				return store.Complete(ctx, "key", "first", []byte("response"))
+			},
+			wantResponse: "response",
+		},
+		{
+			name: "released",
+			steps: func(store *MemoryIdempotencyStore) error {
+				_, err := store.Reserve(ctx, "key", "first")
+				if err != nil {
+					return err
+				}
+				return store.Release(ctx, "key", "first")
+			},
+		},
+		{
+			name: "released by another token",
+			steps: func(store *MemoryIdempotencyStore) error {
+				_, err := store.Reserve(ctx, "key", "first")
+				if err != nil {
+					return err
+				}
+				return store.Release(ctx, "key", "other")
+			},
+			wantErr: ErrIdempotencyKeyInProgress,
+		},
+		{
+			name: "reservation expired",
+			steps: func(store *MemoryIdempotencyStore) error {
+				store.reservationTTL = 0
+				_, err := store.Reserve(ctx, "key", "first")
+				time.Sleep(time.Millisecond)
+				return err
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryIdempotencyStore(time.Hour, time.Minute)
+			err := test.steps(store)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			response, err := store.Reserve(ctx, "key", "second")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+			if string(response) != test.wantResponse {
+				t.Errorf("got response %q, want %q", response, test.wantResponse)
+			}
+		})
+	}
+}
+
+func TestMemoryIdempotencyStoreCompleteTakenOver(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore(time.Hour, 0)
+	if _, err := store.Reserve(ctx, "key", "first"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := store.Reserve(ctx, "key", "second"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := store.Complete(ctx, "key", "first", []byte("stale"))
+	if !errors.Is(err, ErrIdempotencyReservationLost) {
+		t.Fatalf("got %v, want %v", err, ErrIdempotencyReservationLost)
+	}
+	err = store.Complete(ctx, "key", "second", []byte("response"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	response, err := store.Reserve(ctx, "key", "third")
+	if err != nil || string(response) != "response" {
+		t.Errorf("got %q, %v, want the response of the second reservation", response, err)
+	}
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore holds the records of the in-memory repositories. It is safe for concurrent use
+// and is meant to be shared by all the repositories built during the process lifetime.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	records map[string]map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: map[string]map[string]Record{},
+	}
+}
+
+// MemoryRepository mimics the DynamoDbRepository semantics (prefix listing inside a namespace,
+// versioned records, deleting a missing record is not an error) without any external service.
+type MemoryRepository struct {
+	tracer trace.Tracer
+	logger *log.Entry
+	store  *MemoryStore
+}
+
+func NewMemoryRepository(tracer trace.Tracer, log *log.Entry, store *MemoryStore) *MemoryRepository {
+	return &MemoryRepository{
+		tracer: tracer,
+		logger: log.WithField("table_name", "memory"),
+		store:  store,
+	}
+}
+
+func (m MemoryRepository) Create(ctx context.Context, namespace string, key string, info string, overwrite bool) (*Record, error) {
+	ctx, span := m.tracer.Start(ctx,
+		"Create record",
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+			attribute.String("info", info),
+			attribute.Bool("overwrite", overwrite),
+		))
+	defer span.End()
+
+	logger := m.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace": namespace,
+		"key":       key,
+		"info":      info,
+		"overwrite": overwrite,
+	})
+
+	logger.Info("Saving memory record")
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	records, found := m.store.records[namespace]
+	if !found {
+		records = map[string]Record{}
+		m.store.records[namespace] = records
+	}
+	now := time.Now().UTC()
+	record, exists := records[key]
+	switch {
+	case exists && !overwrite:
+		conflict := &ConflictError{Namespace: namespace, Key: key, CurrentVersion: record.Version}
+		logger.WithError(conflict).Info("Memory record already exists")
+		return nil, conflict
+	case !exists:
+		record = Record{Namespace: namespace, Key: key, CreatedAt: now}
+	}
+	record.Info = info
+	record.Version++
+	record.UpdatedAt = now
+	records[key] = record
+	logger.WithField("version", record.Version).Info("Memory record successfully created")
+
+	return &record, nil
+}
+
+func (m MemoryRepository) Get(ctx context.Context, namespace string, key string) (*Record, error) {
+	ctx, span := m.tracer.Start(ctx,
+		"Get record",
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+		),
+	)
+	defer span.End()
+
+	logger := m.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace": namespace,
+		"key":       key,
+	})
+
+	logger.Info("Fetching memory record")
+	m.store.mutex.RLock()
+	defer m.store.mutex.RUnlock()
+
+	record, found := m.store.records[namespace][key]
+	if !found {
+		logger.Info("Memory record not found")
+		return nil, ErrRecordNotFound
+	}
+	logger.Info("Memory record successfully fetched")
+
+	return &record, nil
+}
+
+func (m MemoryRepository) List(ctx context.Context, namespace string, key string, limit int32, cursor string) (*RecordPage, error) {
+	limit = normalizeListLimit(limit)
+	ctx, span := m.tracer.Start(ctx,
+		"List records",
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+			attribute.Int("limit", int(limit)),
+			attribute.Bool("has_cursor", cursor != ""),
+		),
+	)
+	defer span.End()
+
+	logger := m.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace": namespace,
+		"key":       key,
+		"limit":     limit,
+	})
+
+	startKey, err := decodeCursor(cursor, namespace, key)
+	if err != nil {
+		logger.WithError(err).Warn("failed to decode cursor")
+		return nil, err
+	}
+	startAfter := ""
+	if value, ok := startKey["key"].(*types.AttributeValueMemberS); ok {
+		startAfter = value.Value
+	}
+
+	logger.Info("Querying memory records")
+	m.store.mutex.RLock()
+	defer m.store.mutex.RUnlock()
+
+	records := m.store.records[namespace]
+	keys := make([]string, 0, len(records))
+	for recordKey := range records {
+		if strings.HasPrefix(recordKey, key) && recordKey > startAfter {
+			keys = append(keys, recordKey)
+		}
+	}
+	sort.Strings(keys)
+
+	page := &RecordPage{Records: make([]Record, 0, limit)}
+	for _, recordKey := range keys {
+		if len(page.Records) == int(limit) {
+			break
+		}
+		page.Records = append(page.Records, records[recordKey])
+	}
+	if len(keys) > len(page.Records) {
+		last := page.Records[len(page.Records)-1]
+		page.NextCursor, err = encodeCursor(map[string]types.AttributeValue{
+			"namespace": &types.AttributeValueMemberS{Value: last.Namespace},
+			"key":       &types.AttributeValueMemberS{Value: last.Key},
+		})
+		if err != nil {
+			logger.WithError(err).Error("failed to encode cursor")
+			return nil, err
+		}
+	}
+	logger.WithField("count", len(page.Records)).Info("Finish querying memory records successfully")
+
+	return page, nil
+}
+
+func (m MemoryRepository) Update(ctx context.Context, namespace string, key string, info string, condition UpdateCondition) (*Record, error) {
+	ctx, span := m.tracer.Start(ctx,
+		"Update record",
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+			attribute.String("info", info),
+			attribute.Bool("conditional", condition.ExpectedInfo != nil),
+			attribute.Bool("versioned", condition.ExpectedVersion != nil),
+		),
+	)
+	defer span.End()
+
+	logger := m.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace":   namespace,
+		"key":         key,
+		"info":        info,
+		"conditional": condition.ExpectedInfo != nil,
+		"versioned":   condition.ExpectedVersion != nil,
+	})
+
+	logger.Info("Updating memory record")
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	record, found := m.store.records[namespace][key]
+	if !found {
+		logger.Info("Memory record not found")
+		return nil, ErrRecordNotFound
+	}
+	if condition.ExpectedVersion != nil && record.Version != *condition.ExpectedVersion {
+		conflict := &ConflictError{Namespace: namespace, Key: key, ExpectedVersion: condition.ExpectedVersion, CurrentVersion: record.Version}
+		logger.WithError(conflict).Info("Memory record does not match the update condition")
+		return nil, conflict
+	}
+	if condition.ExpectedInfo != nil && record.Info != *condition.ExpectedInfo {
+		logger.Info("Memory record does not match the update condition")
+		return nil, ErrConditionFailed
+	}
+	record.Info = info
+	record.Version++
+	record.UpdatedAt = time.Now().UTC()
+	m.store.records[namespace][key] = record
+	logger.WithField("version", record.Version).Info("Memory record successfully updated")
+
+	return &record, nil
+}
+
+func (m MemoryRepository) Delete(ctx context.Context, namespace string, key string, expectedVersion *int64) (bool, error) {
+	ctx, span := m.tracer.Start(ctx,
+		"Delete record",
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+			attribute.Bool("versioned", expectedVersion != nil),
+		),
+	)
+	defer span.End()
+
+	logger := m.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace": namespace,
+		"key":       key,
+		"versioned": expectedVersion != nil,
+	})
+
+	logger.Info("Deleting memory record")
+	m.store.mutex.Lock()
+	defer m.store.mutex.Unlock()
+
+	record, found := m.store.records[namespace][key]
+	if expectedVersion != nil {
+		if !found {
+			logger.Info("Memory record not found")
+			return false, ErrRecordNotFound
+		}
+		if record.Version != *expectedVersion {
+			conflict := &ConflictError{Namespace: namespace, Key: key, ExpectedVersion: expectedVersion, CurrentVersion: record.Version}
+			logger.WithError(conflict).Info("Memory record does not match the delete condition")
+			return false, conflict
+		}
+	}
+	span.SetAttributes(attribute.Bool("deleted", found))
+	if !found {
+		logger.Info("Memory record not found, nothing deleted")
+		return false, nil
+	}
+	delete(m.store.records[namespace], key)
+	logger.Info("Memory record successfully deleted")
+
+	return true, nil
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace/noop"
+	"io"
+	"slices"
+	"testing"
+)
+
+func newTestRepository(t *testing.T, records ...Record) *MemoryRepository {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	repository := NewMemoryRepository(noop.NewTracerProvider().Tracer("test"), log.NewEntry(logger), NewMemoryStore())
+	for _, record := range records {
+		_, err := repository.Create(context.Background(), record.Namespace, record.Key, record.Info, false)
+		if err != nil {
+			t.Fatalf("seeding %s/%s: %v", record.Namespace, record.Key, err)
+		}
+	}
+	return repository
+}
+
+func recordKeys(records []Record) []string {
+	keys := make([]string, 0, len(records))
+	for _, record := range records {
+		keys = append(keys, record.Key)
+	}
+	return keys
+}
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+func TestMemoryRepositoryCreate(t *testing.T) {
+	tests := []struct {
+		name        string
+		overwrite   bool
+		existing    bool
+		wantVersion int64
+		wantErr     bool
+	}{
+		{name: "new record", wantVersion: 1},
+		{name: "new record with overwrite", overwrite: true, wantVersion: 1},
+		{name: "existing record", existing: true, wantErr: true},
+		{name: "existing record with overwrite", existing: true, overwrite: true, wantVersion: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var seed []Record
+			if test.existing {
+				seed = append(seed, Record{Namespace: "tenant", Key: "key", Info: "old"})
+			}
+			repository := newTestRepository(t, seed...)
+
+			record, err := repository.Create(context.Background(), "tenant", "key", "new", test.overwrite)
+			if test.wantErr {
+				var conflict *ConflictError
+				if !errors.As(err, &conflict) || conflict.CurrentVersion != 1 || conflict.ExpectedVersion != nil {
+					t.Fatalf("got %v, want a conflict with the current version 1", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if record.Version != test.wantVersion || record.Info != "new" {
+				t.Errorf("got version %d and info %q, want version %d and info %q", record.Version, record.Info, test.wantVersion, "new")
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryList(t *testing.T) {
+	repository := newTestRepository(t,
+		Record{Namespace: "tenant", Key: "a2"},
+		Record{Namespace: "tenant", Key: "a1"},
+		Record{Namespace: "tenant", Key: "a3"},
+		Record{Namespace: "tenant", Key: "b1"},
+		Record{Namespace: "other", Key: "a4"},
+	)
+
+	tests := []struct {
+		name      string
+		namespace string
+		prefix    string
+		limit     int32
+		wantPages [][]string
+	}{
+		{name: "prefix", namespace: "tenant", prefix: "a", limit: 10, wantPages: [][]string{{"a1", "a2", "a3"}}},
+		{name: "whole namespace", namespace: "tenant", limit: 10, wantPages: [][]string{{"a1", "a2", "a3", "b1"}}},
+		{name: "other namespace", namespace: "other", prefix: "a", limit: 10, wantPages: [][]string{{"a4"}}},
+		{name: "no match", namespace: "tenant", prefix: "c", limit: 10, wantPages: [][]string{{}}},
+		{name: "paged", namespace: "tenant", prefix: "a", limit: 2, wantPages: [][]string{{"a1", "a2"}, {"a3"}}},
+		{name: "exact pages", namespace: "tenant", limit: 2, wantPages: [][]string{{"a1", "a2"}, {"a3", "b1"}}},
+		{name: "default limit", namespace: "tenant", prefix: "b", wantPages: [][]string{{"b1"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor := ""
+			for i, want := range test.wantPages {
+				page, err := repository.List(context.Background(), test.namespace, test.prefix, test.limit, cursor)
+				if err != nil {
+					t.Fatalf("page %d: unexpected error: %v", i, err)
+				}
+				if got := recordKeys(page.Records); !slices.Equal(got, want) {
+					t.Fatalf("page %d: got %v, want %v", i, got, want)
+				}
+				last := i == len(test.wantPages)-1
+				if last != (page.NextCursor == "") {
+					t.Fatalf("page %d: got cursor %q, last page %t", i, page.NextCursor, last)
+				}
+				cursor = page.NextCursor
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryListRejectsForeignCursors(t *testing.T) {
+	repository := newTestRepository(t,
+		Record{Namespace: "tenant", Key: "a1"},
+		Record{Namespace: "tenant", Key: "a2"},
+		Record{Namespace: "tenant", Key: "b1"},
+		Record{Namespace: "other", Key: "a1"},
+	)
+	page, err := repository.List(context.Background(), "tenant", "a", 1, "")
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("got %v, %v, want a page with a cursor", page, err)
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		prefix    string
+		cursor    string
+	}{
+		{name: "other namespace", namespace: "other", prefix: "a", cursor: page.NextCursor},
+		{name: "other prefix", namespace: "tenant", prefix: "b", cursor: page.NextCursor},
+		{name: "not base64", namespace: "tenant", prefix: "a", cursor: "%%%"},
+		{name: "not json", namespace: "tenant", prefix: "a", cursor: "bm90LWpzb24"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := repository.List(context.Background(), test.namespace, test.prefix, 1, test.cursor)
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("got %v, want %v", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryUpdate(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          string
+		condition    UpdateCondition
+		wantVersion  int64
+		wantErr      error
+		wantConflict bool
+	}{
+		{name: "unconditional", key: "key", wantVersion: 2},
+		{name: "expected version", key: "key", condition: UpdateCondition{ExpectedVersion: int64Ptr(1)}, wantVersion: 2},
+		{name: "stale version", key: "key", condition: UpdateCondition{ExpectedVersion: int64Ptr(2)}, wantConflict: true},
+		{name: "expected info", key: "key", condition: UpdateCondition{ExpectedInfo: stringPtr("old")}, wantVersion: 2},
+		{name: "other info", key: "key", condition: UpdateCondition{ExpectedInfo: stringPtr("other")}, wantErr: ErrConditionFailed},
+		{name: "missing record", key: "missing", wantErr: ErrRecordNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := newTestRepository(t, Record{Namespace: "tenant", Key: "key", Info: "old"})
+
+			record, err := repository.Update(context.Background(), "tenant", test.key, "new", test.condition)
+			switch {
+			case test.wantConflict:
+				var conflict *ConflictError
+				if !errors.As(err, &conflict) || conflict.CurrentVersion != 1 {
+					t.Fatalf("got %v, want a conflict with the current version 1", err)
+				}
+			case test.wantErr != nil:
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got %v, want %v", err, test.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case record.Version != test.wantVersion || record.Info != "new":
+				t.Fatalf("got version %d and info %q, want version %d and info %q", record.Version, record.Info, test.wantVersion, "new")
+			}
+		})
+	}
+}
+
+func TestMemoryRepositoryDelete(t *testing.T) {
+	tests := []struct {
+		name            string
+		key             string
+		expectedVersion *int64
+		wantErr         error
+		wantConflict    bool
+		wantDeleted     bool
+	}{
+		{name: "unversioned", key: "key", wantDeleted: true},
+		{name: "expected version", key: "key", expectedVersion: int64Ptr(1), wantDeleted: true},
+		{name: "stale version", key: "key", expectedVersion: int64Ptr(2), wantConflict: true},
+		{name: "missing record", key: "missing"},
+		{name: "missing record with version", key: "missing", expectedVersion: int64Ptr(1), wantErr: ErrRecordNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := newTestRepository(t, Record{Namespace: "tenant", Key: "key", Info: "info"})
+
+			deleted, err := repository.Delete(context.Background(), "tenant", test.key, test.expectedVersion)
+			if deleted != test.wantDeleted {
+				t.Errorf("got deleted %t, want %t", deleted, test.wantDeleted)
+			}
+			switch {
+			case test.wantConflict:
+				var conflict *ConflictError
+				if !errors.As(err, &conflict) || conflict.CurrentVersion != 1 {
+					t.Fatalf("got %v, want a conflict with the current version 1", err)
+				}
+			case !errors.Is(err, test.wantErr):
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+
+			_, err = repository.Get(context.Background(), "tenant", "key")
+			if missing := errors.Is(err, ErrRecordNotFound); missing != test.wantDeleted {
+				t.Errorf("got record missing %t, want %t", missing, test.wantDeleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/smithy-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"time"
+)
+
+type repositoryMetrics struct {
+	system   string
+	duration metric.Float64Histogram
+	errors   metric.Int64Counter
+}
+
+func newRepositoryMetrics(meter metric.Meter, system string) (*repositoryMetrics, error) {
+	duration, err1 := meter.Float64Histogram("db.client.operation.duration",
+		metric.WithDescription("Duration of the repository operations"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10))
+	errorsCounter, err2 := meter.Int64Counter("db.client.operation.errors",
+		metric.WithDescription("Failed repository operations"),
+		metric.WithUnit("{error}"))
+
+	err := errors.Join(err1, err2)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repositoryMetrics{
+		system:   system,
+		duration: duration,
+		errors:   errorsCounter,
+	}, nil
+}
+
+func (m *repositoryMetrics) record(ctx context.Context, operation string, fn func() error) error {
+	started := time.Now()
+	err := fn()
+
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", m.system),
+		attribute.String("db.operation", operation),
+	}
+	if err != nil {
+		errorType := "error"
+		var apiErr smithy.APIError
+		var conflictErr *ConflictError
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			errorType = "not_found"
+		case errors.Is(err, ErrConditionFailed):
+			errorType = "condition_failed"
+		case errors.As(err, &conflictErr):
+			errorType = "conflict"
+		case errors.As(err, &apiErr):
+			errorType = apiErr.ErrorCode()
+		}
+		m.errors.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.String("error.type", errorType))...))
+		attrs = append(attrs, attribute.String("status", "error"))
+	} else {
+		attrs = append(attrs, attribute.String("status", "ok"))
+	}
+	m.duration.Record(ctx, time.Since(started).Seconds(), metric.WithAttributes(attrs...))
+
+	return err
+}
+
+// MeteredRepository records the latency and errors of every operation of another repository
+type MeteredRepository struct {
+	repository Repository
+	metrics    *repositoryMetrics
+}
+
+// NewMeteredRepositoryFactory wraps the repositories built by factory, the instruments are created once
+func NewMeteredRepositoryFactory(factory RepositoryFactory, meter metric.Meter, system string) (RepositoryFactory, error) {
+	metrics, err := newRepositoryMetrics(meter, system)
+	if err != nil {
+		return nil, err
+	}
+	return func(log *log.Entry) Repository {
+		return MeteredRepository{
+			repository: factory(log),
+			metrics:    metrics,
+		}
+	}, nil
+}
+
+func (m MeteredRepository) Create(ctx context.Context, namespace string, key string, info string, overwrite bool) (*Record, error) {
+	var record *Record
+	err := m.metrics.record(ctx, "create", func() error {
+		var err error
+		record, err = m.repository.Create(ctx, namespace, key, info, overwrite)
+		return err
+	})
+	return record, err
+}
+
+func (m MeteredRepository) Get(ctx context.Context, namespace string, key string) (*Record, error) {
+	var record *Record
+	err := m.metrics.record(ctx, "get", func() error {
+		var err error
+		record, err = m.repository.Get(ctx, namespace, key)
+		return err
+	})
+	return record, err
+}
+
+func (m MeteredRepository) List(ctx context.Context, namespace string, key string, limit int32, cursor string) (*RecordPage, error) {
+	var page *RecordPage
+	err := m.metrics.record(ctx, "list", func() error {
+		var err error
+		page, err = m.repository.List(ctx, namespace, key, limit, cursor)
+		return err
+	})
+	return page, err
+}
+
+func (m MeteredRepository) Update(ctx context.Context, namespace string, key string, info string, condition UpdateCondition) (*Record, error) {
+	var record *Record
+	err := m.metrics.record(ctx, "update", func() error {
+		var err error
+		record, err = m.repository.Update(ctx, namespace, key, info, condition)
+		return err
+	})
+	return record, err
+}
+
+func (m MeteredRepository) Delete(ctx context.Context, namespace string, key string, expectedVersion *int64) (bool, error) {
+	var deleted bool
+	err := m.metrics.record(ctx, "delete", func() error {
+		var err error
+		deleted, err = m.repository.Delete(ctx, namespace, key, expectedVersion)
+		return err
+	})
+	return deleted, err
+}
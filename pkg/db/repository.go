@@ -2,9 +2,11 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -15,137 +17,490 @@ import (
 	"time"
 )
 
+const (
+	DefaultListLimit = 25
+	MaxListLimit     = 100
+)
+
+// records are partitioned by namespace (partition key) and sorted by key (sort key),
+// so listing by key prefix is a query inside a single namespace
+// records are versioned: every write increments the version, starting at 1 on creation
+type Record struct {
+	Namespace string    `dynamodbav:"namespace" json:"namespace"`
+	Key       string    `dynamodbav:"key" json:"key"`
+	Info      string    `dynamodbav:"info" json:"info"`
+	Version   int64     `dynamodbav:"version" json:"version"`
+	CreatedAt time.Time `dynamodbav:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `dynamodbav:"updatedAt" json:"updatedAt"`
+}
+
+var (
+	ErrRecordNotFound  = errors.New("record not found")
+	ErrConditionFailed = errors.New("record does not match the update condition")
+)
+
+// ConflictError reports a write rejected because of the record version: the record already exists
+// (create without overwrite) or its version is not the expected one (update, delete)
+type ConflictError struct {
+	Namespace string
+	Key       string
+	// nil for a create
+	ExpectedVersion *int64
+	CurrentVersion  int64
+}
+
+func (e *ConflictError) Error() string {
+	if e.ExpectedVersion == nil {
+		return fmt.Sprintf("record %s/%s already exists with version %d", e.Namespace, e.Key, e.CurrentVersion)
+	}
+	return fmt.Sprintf("record %s/%s has version %d, expected version %d", e.Namespace, e.Key, e.CurrentVersion, *e.ExpectedVersion)
+}
+
+// UpdateCondition restricts an update to a record in the expected state, nil fields are not checked
+type UpdateCondition struct {
+	ExpectedInfo    *string
+	ExpectedVersion *int64
+}
+
+type RecordPage struct {
+	Records    []Record
+	NextCursor string
+}
+
 type Repository interface {
-	Create(key string, info string) error
-	List(key string) error
-	Delete(key string) error
+	// Create fails with a ConflictError when the record already exists, unless overwrite is set
+	Create(ctx context.Context, namespace string, key string, info string, overwrite bool) (*Record, error)
+	// Get returns ErrRecordNotFound when there is no record with the key
+	Get(ctx context.Context, namespace string, key string) (*Record, error)
+	List(ctx context.Context, namespace string, key string, limit int32, cursor string) (*RecordPage, error)
+	// Update replaces the info of an existing record (ErrRecordNotFound otherwise) if it matches
+	// the condition: a ConflictError for another version, ErrConditionFailed for another info.
+	Update(ctx context.Context, namespace string, key string, info string, condition UpdateCondition) (*Record, error)
+	// Delete tells if a record was deleted. Deleting a missing record is not an error, unless expectedVersion
+	// is set (ErrRecordNotFound), a record with another version is not deleted (ConflictError)
+	Delete(ctx context.Context, namespace string, key string, expectedVersion *int64) (bool, error)
+}
+
+// RepositoryFactory binds a repository to the logger of the message being processed.
+// Building a repository is cheap: the expensive parts (clients, stores) are built once and shared.
+type RepositoryFactory func(log *log.Entry) Repository
+
+func NewDynamoDbRepositoryFactory(client *dynamodb.Client, tracer trace.Tracer, tableName string) RepositoryFactory {
+	return func(log *log.Entry) Repository {
+		return NewDynamoDbRepository(client, tracer, log, tableName)
+	}
+}
+
+func NewMemoryRepositoryFactory(tracer trace.Tracer, store *MemoryStore) RepositoryFactory {
+	return func(log *log.Entry) Repository {
+		return NewMemoryRepository(tracer, log, store)
+	}
+}
+
+func normalizeListLimit(limit int32) int32 {
+	if limit <= 0 {
+		return DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		return MaxListLimit
+	}
+	return limit
 }
 
 type DynamoDbRepository struct {
-	context   context.Context
 	tracer    trace.Tracer
 	logger    *log.Entry
 	client    *dynamodb.Client
 	tableName string
 }
 
-func NewDynamoDbRepository(context context.Context, tracer trace.Tracer, log *log.Entry, tableName string) (*DynamoDbRepository, error) {
-	logger := log.WithField("table_name", tableName)
+// NewDynamoDbClient loads the AWS config and builds the dynamodb client. It is meant to be called
+// once at startup, the client is safe for concurrent use.
+// The sdk retryer is disabled: the retries are made by RetryingRepository, which knows which
+// operations can be safely replayed.
+func NewDynamoDbClient(context context.Context, log *log.Entry) (*dynamodb.Client, error) {
+	logger := log
 
 	logger.Info("Building dynamodb client")
-	cfg, err := config.LoadDefaultConfig(context)
+	cfg, err := config.LoadDefaultConfig(context, config.WithRetryer(func() aws.Retryer {
+		return aws.NopRetryer{}
+	}))
 	if err != nil {
 		logger.WithError(err).Error("failed to AWS load config")
 		return nil, err
 	}
 	logger.Info("Dynamodb client build successful")
 
+	return dynamodb.NewFromConfig(cfg), nil
+}
+
+// CheckTable fails when the table cannot be described or is not active, for the readiness probe
+func CheckTable(ctx context.Context, client *dynamodb.Client, tableName string) error {
+	output, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return err
+	}
+	if output.Table.TableStatus != types.TableStatusActive {
+		return fmt.Errorf("table %s is %s", tableName, output.Table.TableStatus)
+	}
+	return nil
+}
+
+func NewDynamoDbRepository(client *dynamodb.Client, tracer trace.Tracer, log *log.Entry, tableName string) *DynamoDbRepository {
 	return &DynamoDbRepository{
-		context:   context,
-		logger:    logger,
-		client:    dynamodb.NewFromConfig(cfg),
+		logger:    log.WithField("table_name", tableName),
+		client:    client,
 		tableName: tableName,
 		tracer:    tracer,
-	}, nil
+	}
 }
 
-func (d DynamoDbRepository) Create(key string, info string) error {
-	ctx, span := d.tracer.Start(d.context,
+func (d DynamoDbRepository) Create(ctx context.Context, namespace string, key string, info string, overwrite bool) (*Record, error) {
+	ctx, span := d.tracer.Start(ctx,
 		"Create record",
 		trace.WithAttributes(
+			attribute.String("namespace", namespace),
 			attribute.String("key", key),
 			attribute.String("info", info),
+			attribute.Bool("overwrite", overwrite),
 		))
 	defer span.End()
 
 	logger := d.logger.WithContext(ctx).WithFields(log.Fields{
-		"key":  key,
-		"info": key,
+		"namespace": namespace,
+		"key":       key,
+		"info":      info,
+		"overwrite": overwrite,
 	})
 
+	// an update creates the record or, with overwrite, replaces its info keeping the version sequence
+	now := time.Now().UTC()
+	builder := expression.NewBuilder().WithUpdate(expression.
+		Set(expression.Name("info"), expression.Value(info)).
+		Set(expression.Name("version"), nextVersion()).
+		Set(expression.Name("createdAt"), expression.IfNotExists(expression.Name("createdAt"), expression.Value(now))).
+		Set(expression.Name("updatedAt"), expression.Value(now)))
+	if !overwrite {
+		builder = builder.WithCondition(expression.AttributeNotExists(expression.Name("key")))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		logger.WithError(err).Error("failed to build create expression")
+		return nil, err
+	}
+
 	logger.Info("Saving dynamodb record")
-	_, err := d.client.PutItem(d.context, &dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item: map[string]types.AttributeValue{
-			"key":  &types.AttributeValueMemberS{Value: key},
-			"info": &types.AttributeValueMemberS{Value: info},
-		},
+	output, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(d.tableName),
+		Key:                                 recordKey(namespace, key),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		UpdateExpression:                    expr.Update(),
+		ConditionExpression:                 expr.Condition(),
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		conflict := &ConflictError{Namespace: namespace, Key: key, CurrentVersion: itemVersion(conditionErr.Item)}
+		logger.WithError(conflict).Info("Dynamodb record already exists")
+		return nil, conflict
+	}
 	if err != nil {
 		logger.WithError(err).Error("failed to save dynamodb record")
-		return err
+		return nil, err
 	}
-	logger.Info("Dynamodb record successfully created")
+
+	record := &Record{}
+	err = attributevalue.UnmarshalMap(output.Attributes, record)
+	if err != nil {
+		logger.WithError(err).Error("failed to decode dynamodb record")
+		return nil, err
+	}
+	logger.WithField("version", record.Version).Info("Dynamodb record successfully created")
 
 	d.aSubTask(ctx, "After create record", false)
 
-	return nil
+	return record, nil
+}
+
+func (d DynamoDbRepository) Get(ctx context.Context, namespace string, key string) (*Record, error) {
+	ctx, span := d.tracer.Start(ctx,
+		"Get record",
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+		),
+	)
+	defer span.End()
+
+	logger := d.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace": namespace,
+		"key":       key,
+	})
+
+	logger.Info("Fetching dynamodb record")
+	output, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       recordKey(namespace, key),
+	})
+	if err != nil {
+		logger.WithError(err).Error("failed to fetch dynamodb record")
+		return nil, err
+	}
+	if output.Item == nil {
+		logger.Info("Dynamodb record not found")
+		return nil, ErrRecordNotFound
+	}
+
+	record := &Record{}
+	err = attributevalue.UnmarshalMap(output.Item, record)
+	if err != nil {
+		logger.WithError(err).Error("failed to decode dynamodb record")
+		return nil, err
+	}
+	logger.Info("Dynamodb record successfully fetched")
+
+	return record, nil
 }
 
-func (d DynamoDbRepository) List(key string) error {
-	ctx, span := d.tracer.Start(d.context,
+func (d DynamoDbRepository) List(ctx context.Context, namespace string, key string, limit int32, cursor string) (*RecordPage, error) {
+	limit = normalizeListLimit(limit)
+	ctx, span := d.tracer.Start(ctx,
 		"List records",
-		trace.WithAttributes(attribute.String("key", key)),
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+			attribute.Int("limit", int(limit)),
+			attribute.Bool("has_cursor", cursor != ""),
+		),
 	)
 	defer span.End()
 
-	logger := d.logger.WithContext(ctx).WithField("key", key)
+	logger := d.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace": namespace,
+		"key":       key,
+		"limit":     limit,
+	})
+
+	startKey, err := decodeCursor(cursor, namespace, key)
+	if err != nil {
+		logger.WithError(err).Warn("failed to decode cursor")
+		return nil, err
+	}
 
 	logger.Info("Starting dynamodb query")
-	keyEx := expression.Key("key").BeginsWith(key)
+	keyEx := expression.Key("namespace").Equal(expression.Value(namespace))
+	if key != "" {
+		// begins_with does not accept an empty prefix, the whole namespace is listed instead
+		keyEx = keyEx.And(expression.Key("key").BeginsWith(key))
+	}
 	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
 	if err != nil {
 		logger.WithError(err).Error("failed to build search expression")
-		return err
+		return nil, err
 	}
 
 	logger.Info("Querying dynamodb")
-	queryPaginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+	output, err := d.client.Query(ctx, &dynamodb.QueryInput{
 		TableName:                 aws.String(d.tableName),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		KeyConditionExpression:    expr.KeyCondition(),
+		Limit:                     aws.Int32(limit),
+		ExclusiveStartKey:         startKey,
 	})
-	for queryPaginator.HasMorePages() {
-		_, err := queryPaginator.NextPage(d.context)
-		if err != nil {
-			logger.WithError(err).Error("failed to fetch dynamodb record")
-			return err
-		}
-		// mais coisas...
+	if err != nil {
+		logger.WithError(err).Error("failed to fetch dynamodb record")
+		return nil, err
 	}
-	logger.Info("Finish querying dynamodb successfully")
+
+	page := &RecordPage{Records: make([]Record, 0, len(output.Items))}
+	err = attributevalue.UnmarshalListOfMaps(output.Items, &page.Records)
+	if err != nil {
+		logger.WithError(err).Error("failed to decode dynamodb records")
+		return nil, err
+	}
+	page.NextCursor, err = encodeCursor(output.LastEvaluatedKey)
+	if err != nil {
+		logger.WithError(err).Error("failed to encode cursor")
+		return nil, err
+	}
+	logger.WithField("count", len(page.Records)).Info("Finish querying dynamodb successfully")
 
 	d.aSubTask(ctx, "After list records", false)
 
-	return nil
+	return page, nil
 }
 
-func (d DynamoDbRepository) Delete(key string) error {
-	ctx, span := d.tracer.Start(d.context,
+func (d DynamoDbRepository) Update(ctx context.Context, namespace string, key string, info string, condition UpdateCondition) (*Record, error) {
+	ctx, span := d.tracer.Start(ctx,
+		"Update record",
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+			attribute.String("info", info),
+			attribute.Bool("conditional", condition.ExpectedInfo != nil),
+			attribute.Bool("versioned", condition.ExpectedVersion != nil),
+		),
+	)
+	defer span.End()
+
+	logger := d.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace":   namespace,
+		"key":         key,
+		"info":        info,
+		"conditional": condition.ExpectedInfo != nil,
+		"versioned":   condition.ExpectedVersion != nil,
+	})
+
+	conditionEx := expression.AttributeExists(expression.Name("key"))
+	if condition.ExpectedInfo != nil {
+		conditionEx = conditionEx.And(expression.Name("info").Equal(expression.Value(*condition.ExpectedInfo)))
+	}
+	if condition.ExpectedVersion != nil {
+		conditionEx = conditionEx.And(expression.Name("version").Equal(expression.Value(*condition.ExpectedVersion)))
+	}
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.
+			Set(expression.Name("info"), expression.Value(info)).
+			Set(expression.Name("version"), nextVersion()).
+			Set(expression.Name("updatedAt"), expression.Value(time.Now().UTC()))).
+		WithCondition(conditionEx).
+		Build()
+	if err != nil {
+		logger.WithError(err).Error("failed to build update expression")
+		return nil, err
+	}
+
+	logger.Info("Updating dynamodb record")
+	output, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                           aws.String(d.tableName),
+		Key:                                 recordKey(namespace, key),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		UpdateExpression:                    expr.Update(),
+		ConditionExpression:                 expr.Condition(),
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		// the old item tells which part of the condition failed
+		err = conditionFailure(namespace, key, conditionErr.Item, condition.ExpectedVersion)
+		logger.WithError(err).Info("Dynamodb record does not match the update condition")
+		return nil, err
+	}
+	if err != nil {
+		logger.WithError(err).Error("failed to update dynamodb record")
+		return nil, err
+	}
+
+	record := &Record{}
+	err = attributevalue.UnmarshalMap(output.Attributes, record)
+	if err != nil {
+		logger.WithError(err).Error("failed to decode dynamodb record")
+		return nil, err
+	}
+	logger.WithField("version", record.Version).Info("Dynamodb record successfully updated")
+
+	d.aSubTask(ctx, "After update record", false)
+
+	return record, nil
+}
+
+func (d DynamoDbRepository) Delete(ctx context.Context, namespace string, key string, expectedVersion *int64) (bool, error) {
+	ctx, span := d.tracer.Start(ctx,
 		"Delete record",
-		trace.WithAttributes(attribute.String("key", key)),
+		trace.WithAttributes(
+			attribute.String("namespace", namespace),
+			attribute.String("key", key),
+			attribute.Bool("versioned", expectedVersion != nil),
+		),
 	)
 	defer span.End()
 
-	logger := d.logger.WithContext(ctx).WithField("key", key)
+	logger := d.logger.WithContext(ctx).WithFields(log.Fields{
+		"namespace": namespace,
+		"key":       key,
+		"versioned": expectedVersion != nil,
+	})
 
-	logger.Info("Deleting dynamodb record")
-	_, err := d.client.DeleteItem(d.context, &dynamodb.DeleteItemInput{
+	input := &dynamodb.DeleteItemInput{
 		TableName: aws.String(d.tableName),
-		Key: map[string]types.AttributeValue{
-			"key": &types.AttributeValueMemberS{Value: key},
-		},
-	})
+		Key:       recordKey(namespace, key),
+		// the deleted item, nothing when there was no record
+		ReturnValues: types.ReturnValueAllOld,
+	}
+	if expectedVersion != nil {
+		expr, err := expression.NewBuilder().
+			WithCondition(expression.Name("version").Equal(expression.Value(*expectedVersion))).
+			Build()
+		if err != nil {
+			logger.WithError(err).Error("failed to build delete expression")
+			return false, err
+		}
+		input.ExpressionAttributeNames = expr.Names()
+		input.ExpressionAttributeValues = expr.Values()
+		input.ConditionExpression = expr.Condition()
+		input.ReturnValuesOnConditionCheckFailure = types.ReturnValuesOnConditionCheckFailureAllOld
+	}
+
+	logger.Info("Deleting dynamodb record")
+	output, err := d.client.DeleteItem(ctx, input)
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		err = conditionFailure(namespace, key, conditionErr.Item, expectedVersion)
+		logger.WithError(err).Info("Dynamodb record does not match the delete condition")
+		return false, err
+	}
 	if err != nil {
 		logger.WithError(err).Error("failed to delete dynamodb record")
-		return err
+		return false, err
+	}
+	deleted := len(output.Attributes) > 0
+	span.SetAttributes(attribute.Bool("deleted", deleted))
+	if !deleted {
+		logger.Info("Dynamodb record not found, nothing deleted")
+		return false, nil
 	}
 	logger.Info("Dynamodb record successfully deleted")
 
 	d.aSubTask(ctx, "After Delete record", false)
 
-	return nil
+	return true, nil
+}
+
+// nextVersion increments the record version, the records written before versioning start at 0
+func nextVersion() expression.SetValueBuilder {
+	return expression.Plus(expression.IfNotExists(expression.Name("version"), expression.Value(0)), expression.Value(1))
+}
+
+func recordKey(namespace string, key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"namespace": &types.AttributeValueMemberS{Value: namespace},
+		"key":       &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+// itemVersion reads the version of a raw item, 0 for the records written before versioning
+func itemVersion(item map[string]types.AttributeValue) int64 {
+	record := Record{}
+	_ = attributevalue.UnmarshalMap(item, &record)
+	return record.Version
+}
+
+// conditionFailure explains a failed write condition from the record found instead
+func conditionFailure(namespace string, key string, item map[string]types.AttributeValue, expectedVersion *int64) error {
+	if item == nil {
+		return ErrRecordNotFound
+	}
+	if version := itemVersion(item); expectedVersion != nil && version != *expectedVersion {
+		return &ConflictError{Namespace: namespace, Key: key, ExpectedVersion: expectedVersion, CurrentVersion: version}
+	}
+	return ErrConditionFailed
 }
 
 func (d DynamoDbRepository) aSubTask(tctx context.Context, taskName string, final bool) {
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// fraction of the backoff randomly added or removed, between 0 and 1
+	Jitter float64
+}
+
+// aws error codes of transient failures (throttling and server side errors)
+var retryableErrorCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"Throttling":                             true,
+	"RequestLimitExceeded":                   true,
+	"LimitExceededException":                 true,
+	"InternalServerError":                    true,
+	"InternalFailure":                        true,
+	"ServiceUnavailable":                     true,
+	"TransactionInProgressException":         true,
+}
+
+// IsRetryableError tells if a repository error is transient: known aws throttling/server codes
+// and the errors the aws sdk itself considers retryable (timeouts, connection errors, ...)
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if isRejectedError(err) {
+		return true
+	}
+
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// isRejectedError tells if dynamodb answered with a throttling/server code: the request was not
+// applied. Other transient errors (timeouts, connection resets, ...) are ambiguous, a write may
+// have been applied before the response was lost.
+func isRejectedError(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && retryableErrorCodes[apiErr.ErrorCode()]
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(backoff)
+}
+
+// execute runs the operation until it succeeds, fails with a non retryable error or the attempts
+// are exhausted. Every attempt is recorded as an event of the span in ctx, with its error when it failed.
+// An operation that is not idempotent is only retried when the request was rejected: replaying a
+// write applied before a timeout would overwrite newer data or fail on its own result.
+func (p RetryPolicy) execute(ctx context.Context, logger *log.Entry, operation string, idempotent bool, fn func() error) error {
+	span := trace.SpanFromContext(ctx)
+	logger = logger.WithContext(ctx).WithField("operation", operation)
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			span.AddEvent("repository attempt", trace.WithAttributes(
+				attribute.String("operation", operation),
+				attribute.Int("attempt", attempt),
+				attribute.Bool("success", true),
+			))
+			if attempt > 1 {
+				logger.WithField("attempt", attempt).Info("Repository operation succeeded after retrying")
+			}
+			return nil
+		}
+
+		retryable := IsRetryableError(err)
+		ambiguous := retryable && !idempotent && !isRejectedError(err)
+		if ambiguous {
+			retryable = false
+		}
+		attrs := []attribute.KeyValue{
+			attribute.String("operation", operation),
+			attribute.Int("attempt", attempt),
+			attribute.Bool("success", false),
+			attribute.String("error", err.Error()),
+			attribute.Bool("retryable", retryable),
+			attribute.Bool("ambiguous", ambiguous),
+		}
+		if !retryable || attempt >= p.MaxAttempts {
+			span.AddEvent("repository attempt", trace.WithAttributes(attrs...))
+			if ambiguous {
+				logger.WithError(err).WithField("attempt", attempt).
+					Warn("Repository write failed with an ambiguous error, not retrying as it may have been applied")
+			}
+			return err
+		}
+
+		backoff := p.backoff(attempt)
+		span.AddEvent("repository attempt", trace.WithAttributes(
+			append(attrs, attribute.Int64("backoff_ms", backoff.Milliseconds()))...,
+		))
+		logger.WithError(err).WithFields(log.Fields{
+			"attempt": attempt,
+			"backoff": backoff.String(),
+		}).Warn("Repository operation failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// RetryingRepository applies a RetryPolicy around the operations of another repository
+type RetryingRepository struct {
+	repository Repository
+	policy     RetryPolicy
+	logger     *log.Entry
+}
+
+func NewRetryingRepository(repository Repository, log *log.Entry, policy RetryPolicy) *RetryingRepository {
+	return &RetryingRepository{
+		repository: repository,
+		policy:     policy,
+		logger:     log,
+	}
+}
+
+func NewRetryingRepositoryFactory(factory RepositoryFactory, policy RetryPolicy) RepositoryFactory {
+	return func(log *log.Entry) Repository {
+		return NewRetryingRepository(factory(log), log, policy)
+	}
+}
+
+func (r RetryingRepository) Create(ctx context.Context, namespace string, key string, info string, overwrite bool) (*Record, error) {
+	var record *Record
+	err := r.policy.execute(ctx, r.logger, "create", false, func() error {
+		var err error
+		record, err = r.repository.Create(ctx, namespace, key, info, overwrite)
+		return err
+	})
+	return record, err
+}
+
+func (r RetryingRepository) Get(ctx context.Context, namespace string, key string) (*Record, error) {
+	var record *Record
+	err := r.policy.execute(ctx, r.logger, "get", true, func() error {
+		var err error
+		record, err = r.repository.Get(ctx, namespace, key)
+		return err
+	})
+	return record, err
+}
+
+func (r RetryingRepository) List(ctx context.Context, namespace string, key string, limit int32, cursor string) (*RecordPage, error) {
+	var page *RecordPage
+	err := r.policy.execute(ctx, r.logger, "list", true, func() error {
+		var err error
+		page, err = r.repository.List(ctx, namespace, key, limit, cursor)
+		return err
+	})
+	return page, err
+}
+
+func (r RetryingRepository) Update(ctx context.Context, namespace string, key string, info string, condition UpdateCondition) (*Record, error) {
+	var record *Record
+	err := r.policy.execute(ctx, r.logger, "update", false, func() error {
+		var err error
+		record, err = r.repository.Update(ctx, namespace, key, info, condition)
+		return err
+	})
+	return record, err
+}
+
+func (r RetryingRepository) Delete(ctx context.Context, namespace string, key string, expectedVersion *int64) (bool, error) {
+	var deleted bool
+	// deleting a record again is harmless, unless the version is checked
+	err := r.policy.execute(ctx, r.logger, "delete", expectedVersion == nil, func() error {
+		var err error
+		deleted, err = r.repository.Delete(ctx, namespace, key, expectedVersion)
+		return err
+	})
+	return deleted, err
+}
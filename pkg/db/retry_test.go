@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/smithy-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// timeoutError is a network timeout, a request may have been applied before it
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "throttling", err: &smithy.GenericAPIError{Code: "ThrottlingException"}, want: true},
+		{name: "throughput exceeded", err: &smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"}, want: true},
+		{name: "wrapped server error", err: fmt.Errorf("put: %w", &smithy.GenericAPIError{Code: "InternalServerError"}), want: true},
+		{name: "validation", err: &smithy.GenericAPIError{Code: "ValidationException"}, want: false},
+		{name: "connection reset", err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, want: true},
+		{name: "timeout", err: fmt.Errorf("put: %w", timeoutError{}), want: true},
+		{name: "context canceled", err: context.Canceled, want: false},
+		{name: "deadline exceeded", err: fmt.Errorf("get: %w", context.DeadlineExceeded), want: false},
+		{name: "record not found", err: ErrRecordNotFound, want: false},
+		{name: "conflict", err: &ConflictError{Namespace: "tenant", Key: "key", CurrentVersion: 1}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsRetryableError(test.err); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: 100 * time.Millisecond},
+		{attempt: 2, want: 200 * time.Millisecond},
+		{attempt: 4, want: 800 * time.Millisecond},
+		{attempt: 5, want: time.Second},
+		{attempt: 10, want: time.Second},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("attempt %d", test.attempt), func(t *testing.T) {
+			if got := policy.backoff(test.attempt); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+	for i := 0; i < 100; i++ {
+		got := policy.backoff(2)
+		if got < 160*time.Millisecond || got > 240*time.Millisecond {
+			t.Fatalf("got %v, want within 20%% of 200ms", got)
+		}
+	}
+}
+
+func TestRetryPolicyExecute(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException"}
+	timeout := timeoutError{}
+	tests := []struct {
+		name         string
+		idempotent   bool
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "success", idempotent: true, wantAttempts: 1},
+		{name: "retried until success", idempotent: true, errs: []error{throttled, throttled}, wantAttempts: 3},
+		{name: "attempts exhausted", idempotent: true, errs: []error{throttled, throttled, throttled, throttled}, wantAttempts: 3, wantErr: throttled},
+		{name: "not retryable", idempotent: true, errs: []error{ErrRecordNotFound}, wantAttempts: 1, wantErr: ErrRecordNotFound},
+		{name: "idempotent after timeout", idempotent: true, errs: []error{timeout}, wantAttempts: 2},
+		{name: "write rejected", errs: []error{throttled}, wantAttempts: 2},
+		{name: "write after timeout", errs: []error{timeout}, wantAttempts: 1, wantErr: timeout},
+	}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+			ctx, span := tracer.Start(context.Background(), "Process message")
+
+			attempts := 0
+			err := policy.execute(ctx, log.NewEntry(logger), "test", test.idempotent, func() error {
+				attempts++
+				if attempts <= len(test.errs) {
+					return test.errs[attempts-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+			if attempts != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, test.wantAttempts)
+			}
+
+			span.End()
+			events := recorder.Ended()[0].Events()
+			if len(events) != test.wantAttempts {
+				t.Fatalf("got %d span events, want one per attempt", len(events))
+			}
+			for i, event := range events {
+				success := test.wantErr == nil && i == len(events)-1
+				if event.Name != "repository attempt" || !slices.Contains(event.Attributes, attribute.Bool("success", success)) {
+					t.Errorf("got event %q with %v, want an attempt with success %t", event.Name, event.Attributes, success)
+				}
+			}
+		})
+	}
+}
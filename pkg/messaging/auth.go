@@ -0,0 +1,133 @@
+package messaging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"os"
+	"strings"
+)
+
+const (
+	AuthNone         = "none"
+	AuthToken        = "token"
+	AuthUserPassword = "userpass"
+	AuthNKey         = "nkey"
+	AuthCreds        = "creds"
+)
+
+type AuthOptions struct {
+	Mode string
+	// token, or a file with it (e.g. a mounted secret)
+	Token     string
+	TokenFile string
+	User      string
+	Password  string
+	// file with the user NKey seed
+	NKeySeedFile string
+	// JWT .creds file (user JWT + NKey seed)
+	CredsFile string
+}
+
+type TLSOptions struct {
+	Enabled bool
+	// custom CA of the server certificates, the system pool is used when empty
+	CAFile string
+	// client certificate and key, for mTLS
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// authorizationHint explains a connection refused by the server, the local server requires a token
+func (a AuthOptions) authorizationHint() string {
+	if a.Mode == AuthNone || a.Mode == "" {
+		return "the server requires authentication, set nats.auth: -config config.example.yaml for the local server " +
+			"or LTT_NATS_AUTH_MODE=token and LTT_NATS_AUTH_TOKEN"
+	}
+	return fmt.Sprintf("the server refused the %s credentials, check nats.auth", a.Mode)
+}
+
+func (a AuthOptions) natsOptions() ([]nats.Option, error) {
+	switch a.Mode {
+	case AuthNone, "":
+		return nil, nil
+	case AuthToken:
+		token := a.Token
+		if a.TokenFile != "" {
+			data, err := os.ReadFile(a.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read token file: %w", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		if token == "" {
+			return nil, errors.New("token authentication without token")
+		}
+		return []nats.Option{nats.Token(token)}, nil
+	case AuthUserPassword:
+		return []nats.Option{nats.UserInfo(a.User, a.Password)}, nil
+	case AuthNKey:
+		option, err := nats.NkeyOptionFromSeed(a.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load nkey seed: %w", err)
+		}
+		return []nats.Option{option}, nil
+	case AuthCreds:
+		_, err := os.Stat(a.CredsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read creds file: %w", err)
+		}
+		return []nats.Option{nats.UserCredentials(a.CredsFile)}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication mode: %s", a.Mode)
+	}
+}
+
+func (t TLSOptions) natsOptions() ([]nats.Option, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		data, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found on CA file %s", t.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if t.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return []nats.Option{nats.Secure(tlsConfig)}, nil
+}
+
+// connectOptions builds the nats connection options of the configured authentication and TLS
+func (o ProcessorOptions) connectOptions() ([]nats.Option, error) {
+	authOptions, err := o.Auth.natsOptions()
+	if err != nil {
+		return nil, err
+	}
+	tlsOptions, err := o.TLS.natsOptions()
+	if err != nil {
+		return nil, err
+	}
+	return append(authOptions, tlsOptions...), nil
+}
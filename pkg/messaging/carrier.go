@@ -1,7 +1,6 @@
 package messaging
 
 import (
-	"fmt"
 	"github.com/nats-io/nats.go"
 )
 
@@ -25,20 +24,3 @@ func (hc NatsHeaderCarrier) Keys() []string {
 	}
 	return keys
 }
-
-// // MY DEBUGGER
-type DebuggerCarrier struct{}
-
-// Keys lists the keys stored in this carrier.
-func (hc DebuggerCarrier) Keys() []string {
-	return []string{}
-}
-
-func (hc DebuggerCarrier) Get(key string) string {
-	return ""
-}
-
-// Set stores the key-value pair.
-func (hc DebuggerCarrier) Set(key string, value string) {
-	fmt.Printf("CARRIER: %s = %s\n", key, value)
-}
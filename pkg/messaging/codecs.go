@@ -0,0 +1,137 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"sort"
+)
+
+// header with the schema version of a message payload, the current version when missing
+const versionHeader = "version"
+
+const (
+	// MessageVersionV1 messages have no namespace, their records go to the default namespace
+	MessageVersionV1 = "V1"
+	// MessageVersionV2 messages have a namespace and list pagination, get and update only exist in V2
+	MessageVersionV2      = "V2"
+	CurrentMessageVersion = MessageVersionV2
+)
+
+type UnsupportedVersionError struct {
+	Version   string
+	Supported []string
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported message version %q, supported versions: %v", e.Version, e.Supported)
+}
+
+// messageCodec decodes one version of a message payload and upgrades it to the current model
+type messageCodec[T any] func(data []byte) (*T, error)
+
+// versionedCodecs holds the codecs of a message, keyed by version
+type versionedCodecs[T any] map[string]messageCodec[T]
+
+func (c versionedCodecs[T]) decode(msg *nats.Msg) (*T, error) {
+	version := msg.Header.Get(versionHeader)
+	if version == "" {
+		version = CurrentMessageVersion
+	}
+	codec, found := c[version]
+	if !found {
+		return nil, &UnsupportedVersionError{Version: version, Supported: c.versions()}
+	}
+	message, err := codec(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	return message, validate(message)
+}
+
+func (c versionedCodecs[T]) versions() []string {
+	versions := make([]string, 0, len(c))
+	for version := range c {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// upgradeFrom decodes the V payloads strictly, rejecting the fields V does not have
+func upgradeFrom[V any, T any](upgrade func(message *V) *T) messageCodec[T] {
+	return func(data []byte) (*T, error) {
+		message := new(V)
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(message)
+		if err != nil {
+			return nil, err
+		}
+		if decoder.More() {
+			return nil, errors.New("unexpected data after the message")
+		}
+		return upgrade(message), nil
+	}
+}
+
+type createMessageV1 struct {
+	Key  string `json:"key"`
+	Info string `json:"info"`
+}
+
+type listMessageV1 struct {
+	Key string `json:"key"`
+}
+
+type deleteMessageV1 struct {
+	Key string `json:"key"`
+}
+
+var createMessageCodecs = versionedCodecs[CreateMessage]{
+	MessageVersionV1: upgradeFrom(func(message *createMessageV1) *CreateMessage {
+		return &CreateMessage{Namespace: defaultNamespace, Key: message.Key, Info: message.Info}
+	}),
+	MessageVersionV2: upgradeFrom(func(message *CreateMessage) *CreateMessage {
+		message.Namespace = namespaceOrDefault(message.Namespace)
+		return message
+	}),
+}
+
+// get did not exist in V1
+var getMessageCodecs = versionedCodecs[GetMessage]{
+	MessageVersionV2: upgradeFrom(func(message *GetMessage) *GetMessage {
+		message.Namespace = namespaceOrDefault(message.Namespace)
+		return message
+	}),
+}
+
+var listMessageCodecs = versionedCodecs[ListMessage]{
+	MessageVersionV1: upgradeFrom(func(message *listMessageV1) *ListMessage {
+		return &ListMessage{Namespace: defaultNamespace, Key: message.Key}
+	}),
+	MessageVersionV2: upgradeFrom(func(message *ListMessage) *ListMessage {
+		message.Namespace = namespaceOrDefault(message.Namespace)
+		return message
+	}),
+}
+
+// update did not exist in V1
+var updateMessageCodecs = versionedCodecs[UpdateMessage]{
+	MessageVersionV2: upgradeFrom(func(message *UpdateMessage) *UpdateMessage {
+		message.Namespace = namespaceOrDefault(message.Namespace)
+		return message
+	}),
+}
+
+var deleteMessageCodecs = versionedCodecs[DeleteMessage]{
+	MessageVersionV1: upgradeFrom(func(message *deleteMessageV1) *DeleteMessage {
+		return &DeleteMessage{Namespace: defaultNamespace, Key: message.Key}
+	}),
+	MessageVersionV2: upgradeFrom(func(message *DeleteMessage) *DeleteMessage {
+		message.Namespace = namespaceOrDefault(message.Namespace)
+		return message
+	}),
+}
@@ -0,0 +1,120 @@
+package messaging
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go"
+	"reflect"
+	"testing"
+)
+
+func newVersionedMsg(version string, data string) *nats.Msg {
+	msg := nats.NewMsg("subject")
+	if version != "" {
+		msg.Header.Set(versionHeader, version)
+	}
+	msg.Data = []byte(data)
+	return msg
+}
+
+func TestCreateMessageCodecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		data    string
+		want    *CreateMessage
+		wantErr bool
+	}{
+		{name: "V1 upgraded to the default namespace", version: MessageVersionV1, data: `{"key":"key","info":"info"}`,
+			want: &CreateMessage{Namespace: defaultNamespace, Key: "key", Info: "info"}},
+		{name: "V1 has no namespace", version: MessageVersionV1, data: `{"namespace":"tenant","key":"key"}`, wantErr: true},
+		{name: "V2", version: MessageVersionV2, data: `{"namespace":"tenant","key":"key","info":"info","overwrite":true}`,
+			want: &CreateMessage{Namespace: "tenant", Key: "key", Info: "info", Overwrite: true}},
+		{name: "V2 without namespace", version: MessageVersionV2, data: `{"key":"key"}`,
+			want: &CreateMessage{Namespace: defaultNamespace, Key: "key"}},
+		{name: "current version by default", data: `{"namespace":"tenant","key":"key"}`,
+			want: &CreateMessage{Namespace: "tenant", Key: "key"}},
+		{name: "unknown field", version: MessageVersionV2, data: `{"key":"key","other":1}`, wantErr: true},
+		{name: "trailing data", version: MessageVersionV2, data: `{"key":"key"}{"key":"other"}`, wantErr: true},
+		{name: "not json", version: MessageVersionV2, data: `key`, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := deserializeCreateMessage(newVersionedMsg(test.version, test.data))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(message, test.want) {
+				t.Errorf("got %+v, want %+v", message, test.want)
+			}
+		})
+	}
+}
+
+func TestMessageCodecsUpgrades(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(msg *nats.Msg) (any, error)
+		data   string
+		want   any
+	}{
+		{name: "list", data: `{"key":"prefix"}`,
+			decode: func(msg *nats.Msg) (any, error) { return deserializeListMessage(msg) },
+			want:   &ListMessage{Namespace: defaultNamespace, Key: "prefix"}},
+		{name: "delete", data: `{"key":"key"}`,
+			decode: func(msg *nats.Msg) (any, error) { return deserializeDeleteMessage(msg) },
+			want:   &DeleteMessage{Namespace: defaultNamespace, Key: "key"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := test.decode(newVersionedMsg(MessageVersionV1, test.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(message, test.want) {
+				t.Errorf("got %+v, want %+v", message, test.want)
+			}
+		})
+	}
+}
+
+func TestMessageCodecsVersions(t *testing.T) {
+	tests := []struct {
+		name          string
+		decode        func(msg *nats.Msg) error
+		version       string
+		wantSupported []string
+	}{
+		{name: "get did not exist in V1", version: MessageVersionV1, wantSupported: []string{MessageVersionV2},
+			decode: func(msg *nats.Msg) error { _, err := deserializeGetMessage(msg); return err }},
+		{name: "update did not exist in V1", version: MessageVersionV1, wantSupported: []string{MessageVersionV2},
+			decode: func(msg *nats.Msg) error { _, err := deserializeUpdateMessage(msg); return err }},
+		{name: "unknown version", version: "V3", wantSupported: []string{MessageVersionV1, MessageVersionV2},
+			decode: func(msg *nats.Msg) error { _, err := deserializeCreateMessage(msg); return err }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.decode(newVersionedMsg(test.version, `{"namespace":"tenant","key":"key"}`))
+			var versionErr *UnsupportedVersionError
+			if !errors.As(err, &versionErr) {
+				t.Fatalf("got %v, want an unsupported version error", err)
+			}
+			if versionErr.Version != test.version || !reflect.DeepEqual(versionErr.Supported, test.wantSupported) {
+				t.Errorf("got version %q supported %v, want %q supported %v", versionErr.Version, versionErr.Supported, test.version, test.wantSupported)
+			}
+		})
+	}
+}
+
+func TestMessageCodecsValidate(t *testing.T) {
+	_, err := deserializeCreateMessage(newVersionedMsg(MessageVersionV1, `{"key":"bad key"}`))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Fields) != 1 || validationErr.Fields[0].Field != "key" {
+		t.Errorf("got %v, want a validation error of key", err)
+	}
+}
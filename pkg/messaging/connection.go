@@ -0,0 +1,208 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ConnectionDisconnected = "disconnected"
+	ConnectionReconnected  = "reconnected"
+	ConnectionClosed       = "closed"
+	ConnectionSlowConsumer = "slow_consumer"
+	ConnectionError        = "error"
+)
+
+type ReconnectOptions struct {
+	// -1 to reconnect forever
+	MaxAttempts int
+	Wait        time.Duration
+	// random delay added to the wait, so the clients do not reconnect all at once
+	Jitter time.Duration
+	// bytes published while reconnecting, sent once reconnected (-1 to fail the publishes instead)
+	BufferSize int
+}
+
+func (o ReconnectOptions) connectOptions() []nats.Option {
+	return []nats.Option{
+		nats.MaxReconnects(o.MaxAttempts),
+		nats.ReconnectWait(o.Wait),
+		nats.ReconnectJitter(o.Jitter, o.Jitter),
+		nats.ReconnectBufSize(o.BufferSize),
+	}
+}
+
+// ConnectionState is a snapshot of the NATS connection, for the health checks
+type ConnectionState struct {
+	Status     string    `json:"status"`
+	Connected  bool      `json:"connected"`
+	ServerURL  string    `json:"serverUrl,omitempty"`
+	Reconnects uint64    `json:"reconnects"`
+	LastError  string    `json:"lastError,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// connectionState follows the connection from the lifecycle handlers, which run on their own goroutine
+type connectionState struct {
+	mu         sync.Mutex
+	connection *nats.Conn
+	since      time.Time
+	lastError  error
+	// set by Shutdown, a close before it means the reconnect attempts ran out
+	closing atomic.Bool
+}
+
+func (s *connectionState) connected(connection *nats.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connection = connection
+	s.since = time.Now()
+}
+
+func (s *connectionState) changed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since = time.Now()
+	if err != nil {
+		s.lastError = err
+	}
+}
+
+func (n *NatsMessageProcessor) ConnectionState() ConnectionState {
+	n.state.mu.Lock()
+	defer n.state.mu.Unlock()
+
+	state := ConnectionState{
+		Status: nats.DISCONNECTED.String(),
+		Since:  n.state.since,
+	}
+	if n.state.lastError != nil {
+		state.LastError = n.state.lastError.Error()
+	}
+	if connection := n.state.connection; connection != nil {
+		state.Status = connection.Status().String()
+		state.Connected = connection.IsConnected()
+		state.ServerURL = connection.ConnectedUrlRedacted()
+		state.Reconnects = connection.Stats().Reconnects
+	}
+	return state
+}
+
+// observeConnection reports the connection status as a gauge, 1 when connected
+func (n *NatsMessageProcessor) observeConnection() error {
+	_, err := n.meter.Int64ObservableGauge("messaging.connection.connected",
+		metric.WithDescription("NATS connection status, 1 when connected"),
+		metric.WithInt64Callback(func(_ context.Context, observer metric.Int64Observer) error {
+			connected := int64(0)
+			if n.ConnectionState().Connected {
+				connected = 1
+			}
+			observer.Observe(connected)
+			return nil
+		}))
+	return err
+}
+
+func (n *NatsMessageProcessor) connectionHandlers() []nats.Option {
+	return []nats.Option{
+		nats.DisconnectErrHandler(n.disconnectedHandler),
+		nats.ReconnectHandler(n.reconnectedHandler),
+		nats.ClosedHandler(n.closedHandler),
+		nats.ErrorHandler(n.asyncErrorHandler),
+	}
+}
+
+func (n *NatsMessageProcessor) disconnectedHandler(connection *nats.Conn, err error) {
+	n.state.changed(err)
+	if n.state.closing.Load() {
+		return
+	}
+	ctx := n.connectionEvent(ConnectionDisconnected, err)
+	n.logger.WithContext(ctx).WithError(err).WithFields(log.Fields{
+		"status": connection.Status().String(),
+	}).Warn("Disconnected from NATS server")
+}
+
+func (n *NatsMessageProcessor) reconnectedHandler(connection *nats.Conn) {
+	n.state.changed(nil)
+	ctx := n.connectionEvent(ConnectionReconnected, nil,
+		attribute.String("server.address", connection.ConnectedUrlRedacted()))
+	n.logger.WithContext(ctx).WithFields(log.Fields{
+		"server":     connection.ConnectedUrlRedacted(),
+		"reconnects": connection.Stats().Reconnects,
+	}).Info("Reconnected to NATS server")
+}
+
+func (n *NatsMessageProcessor) closedHandler(connection *nats.Conn) {
+	n.state.changed(nil)
+	if n.state.closing.Load() {
+		n.connectionEvent(ConnectionClosed, nil)
+		return
+	}
+	err := connection.LastError()
+	if err == nil {
+		err = nats.ErrConnectionClosed
+	}
+	ctx := n.connectionEvent(ConnectionClosed, err)
+	n.logger.WithContext(ctx).WithError(err).WithFields(log.Fields{
+		"reconnect_attempts": n.options.Reconnect.MaxAttempts,
+	}).Error("NATS connection closed, reconnect attempts exhausted")
+}
+
+// asyncErrorHandler reports the errors of the subscriptions, the messages dropped by a slow consumer
+// (a subscription over its pending limits) are lost unless JetStream redelivers them
+func (n *NatsMessageProcessor) asyncErrorHandler(_ *nats.Conn, subscription *nats.Subscription, err error) {
+	if subscription == nil {
+		ctx := n.connectionEvent(ConnectionError, err)
+		n.logger.WithContext(ctx).WithError(err).Error("NATS asynchronous error")
+		return
+	}
+
+	subjectAttr := attribute.String("messaging.destination.name", subscription.Subject)
+	dropped, _ := subscription.Dropped()
+	pendingMessages, pendingBytes, _ := subscription.Pending()
+	fields := log.Fields{
+		"subject":          subscription.Subject,
+		"dropped":          dropped,
+		"pending_messages": pendingMessages,
+		"pending_bytes":    pendingBytes,
+	}
+	if errors.Is(err, nats.ErrSlowConsumer) {
+		n.metrics.slowConsumer.Add(context.Background(), 1, metric.WithAttributes(subjectAttr))
+		ctx := n.connectionEvent(ConnectionSlowConsumer, err, subjectAttr, attribute.Int("messaging.dropped", dropped))
+		n.logger.WithContext(ctx).WithError(err).WithFields(fields).Warn("Slow consumer, messages dropped over the subscription pending limits")
+		return
+	}
+	ctx := n.connectionEvent(ConnectionError, err, subjectAttr)
+	n.logger.WithContext(ctx).WithError(err).WithFields(fields).Error("NATS subscription error")
+}
+
+// connectionEvent records a connection lifecycle event on its own span and counts it, it returns the
+// context of the span for the logs
+func (n *NatsMessageProcessor) connectionEvent(event string, err error, attrs ...attribute.KeyValue) context.Context {
+	attrs = append(attrs,
+		attribute.String("messaging.system", "nats"),
+		attribute.String("messaging.connection.event", event))
+
+	ctx, span := n.tracer.Start(context.Background(), "NATS connection "+event,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+
+	span.AddEvent(event, trace.WithAttributes(attrs...))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	n.metrics.connectionEvents.Add(ctx, 1, metric.WithAttributes(attribute.String("event", event)))
+	return ctx
+}
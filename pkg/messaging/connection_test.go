@@ -0,0 +1,140 @@
+package messaging
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"testing"
+	"time"
+)
+
+func TestConnectionState(t *testing.T) {
+	processor := newTestProcessor(t, ProcessorOptions{}, nil)
+	state := processor.ConnectionState()
+	if state.Status != nats.DISCONNECTED.String() || state.Connected || !state.Since.IsZero() {
+		t.Errorf("got %+v before connecting, want disconnected", state)
+	}
+
+	started := time.Now()
+	processor.state.connected(newClosedConnection(t))
+	processor.state.changed(errors.New("connection reset"))
+	processor.state.changed(nil)
+
+	state = processor.ConnectionState()
+	if state.Status != nats.CLOSED.String() || state.Connected {
+		t.Errorf("got status %s connected %t, want the status of the connection", state.Status, state.Connected)
+	}
+	// a change without error keeps the last one
+	if state.LastError != "connection reset" || state.Since.Before(started) {
+		t.Errorf("got last error %q since %v, want the last error and change", state.LastError, state.Since)
+	}
+}
+
+func TestConnectionHandlers(t *testing.T) {
+	subscription := &nats.Subscription{Subject: "create"}
+	tests := []struct {
+		name      string
+		closing   bool
+		handle    func(processor *NatsMessageProcessor, connection *nats.Conn)
+		wantEvent string
+		wantError bool
+		wantAttr  attribute.KeyValue
+	}{
+		{
+			name: "disconnected",
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.disconnectedHandler(connection, errors.New("connection reset"))
+			},
+			wantEvent: ConnectionDisconnected,
+			wantError: true,
+		},
+		{
+			name:    "disconnected on shutdown",
+			closing: true,
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.disconnectedHandler(connection, nil)
+			},
+		},
+		{
+			name: "reconnected",
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.reconnectedHandler(connection)
+			},
+			wantEvent: ConnectionReconnected,
+		},
+		{
+			name: "reconnect attempts exhausted",
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.closedHandler(connection)
+			},
+			wantEvent: ConnectionClosed,
+			wantError: true,
+		},
+		{
+			name:    "closed on shutdown",
+			closing: true,
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.closedHandler(connection)
+			},
+			wantEvent: ConnectionClosed,
+		},
+		{
+			name: "slow consumer",
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.asyncErrorHandler(connection, subscription, nats.ErrSlowConsumer)
+			},
+			wantEvent: ConnectionSlowConsumer,
+			wantError: true,
+			wantAttr:  attribute.String("messaging.destination.name", "create"),
+		},
+		{
+			name: "subscription error",
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.asyncErrorHandler(connection, subscription, errors.New("permissions violation for subscription to \"create\""))
+			},
+			wantEvent: ConnectionError,
+			wantError: true,
+			wantAttr:  attribute.String("messaging.destination.name", "create"),
+		},
+		{
+			name: "connection error",
+			handle: func(processor *NatsMessageProcessor, connection *nats.Conn) {
+				processor.asyncErrorHandler(connection, nil, nats.ErrStaleConnection)
+			},
+			wantEvent: ConnectionError,
+			wantError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			processor := newTestProcessor(t, ProcessorOptions{}, nil)
+			processor.state.closing.Store(test.closing)
+
+			test.handle(processor.NatsMessageProcessor, newClosedConnection(t))
+
+			spans := processor.recorder.Ended()
+			if test.wantEvent == "" {
+				if len(spans) != 0 {
+					t.Errorf("got %d spans, want none", len(spans))
+				}
+				return
+			}
+			if len(spans) != 1 || spans[0].Name() != "NATS connection "+test.wantEvent {
+				t.Fatalf("got %d spans, want one for the %s event", len(spans), test.wantEvent)
+			}
+			span := spans[0]
+			if event, _ := spanAttribute(span, "messaging.connection.event"); event.AsString() != test.wantEvent {
+				t.Errorf("got event attribute %q, want %q", event.AsString(), test.wantEvent)
+			}
+			if failed := span.Status().Code == codes.Error; failed != test.wantError {
+				t.Errorf("got span failed %t, want %t", failed, test.wantError)
+			}
+			if test.wantAttr.Valid() {
+				if value, _ := spanAttribute(span, test.wantAttr.Key); value != test.wantAttr.Value {
+					t.Errorf("got %s %v, want %v", test.wantAttr.Key, value.Emit(), test.wantAttr.Value.Emit())
+				}
+			}
+		})
+	}
+}
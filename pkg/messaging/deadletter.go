@@ -0,0 +1,219 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	deadLetterHeaderPrefix    = "Dead-Letter-"
+	deadLetterSubjectHeader   = deadLetterHeaderPrefix + "Subject"
+	deadLetterReasonHeader    = deadLetterHeaderPrefix + "Reason"
+	deadLetterErrorCodeHeader = deadLetterHeaderPrefix + "Error-Code"
+	deadLetterHandlerHeader   = deadLetterHeaderPrefix + "Handler"
+	deadLetterAttemptsHeader  = deadLetterHeaderPrefix + "Attempts"
+	deadLetterRequestIdHeader = deadLetterHeaderPrefix + "Request-Id"
+	deadLetterTimeHeader      = deadLetterHeaderPrefix + "Time"
+	// the JetStream de-duplication id of the original message, kept aside: the streams would drop the
+	// dead letter (and its replay) as a duplicate of the original within their duplicate window
+	deadLetterMsgIdHeader = deadLetterHeaderPrefix + "Msg-Id"
+)
+
+type DeadLetterOptions struct {
+	Enabled bool
+	Subject string
+	// when set, a work queue stream is provisioned to keep the dead letters until they are replayed
+	Stream string
+	// how long the replay waits for more dead letters before finishing
+	ReplayWait time.Duration
+}
+
+type deadLetterPublisher struct {
+	logger     *log.Entry
+	options    DeadLetterOptions
+	connection *nats.Conn
+	publisher  *TracedPublisher
+	js         nats.JetStreamContext
+}
+
+func newDeadLetterPublisher(logger *log.Entry, connection *nats.Conn, tracedPublisher *TracedPublisher, options DeadLetterOptions) (*deadLetterPublisher, error) {
+	publisher := &deadLetterPublisher{
+		logger: logger.WithFields(log.Fields{
+			"dead_letter_subject": options.Subject,
+			"dead_letter_stream":  options.Stream,
+		}),
+		options:    options,
+		connection: connection,
+		publisher:  tracedPublisher,
+	}
+	if options.Stream == "" {
+		return publisher, nil
+	}
+
+	js, err := connection.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	publisher.js = js
+	return publisher, publisher.provisionStream()
+}
+
+func (d *deadLetterPublisher) provisionStream() error {
+	_, err := d.js.StreamInfo(d.options.Stream)
+	if err == nil {
+		d.logger.Info("Dead letter stream already provisioned")
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+
+	d.logger.Info("Creating dead letter stream")
+	_, err = d.js.AddStream(&nats.StreamConfig{
+		Name:      d.options.Stream,
+		Subjects:  []string{d.options.Subject},
+		Storage:   nats.FileStorage,
+		Retention: nats.WorkQueuePolicy,
+	})
+	return err
+}
+
+// publish republishes a failed message on the dead letter subject with the original headers,
+// the trace context of the failed processing and the failure details. When a dead letter stream is
+// configured the publish waits for the stream ack, so the message is only dropped once it is stored.
+func (d *deadLetterPublisher) publish(ctx context.Context, logger *log.Entry, msg *nats.Msg, handler string, response *Response, attempts uint64) error {
+	deadLetter := nats.NewMsg(d.options.Subject)
+	deadLetter.Data = msg.Data
+	for key, values := range msg.Header {
+		deadLetter.Header[key] = values
+	}
+	if msgId := msg.Header.Get(natsMsgIdHeader); msgId != "" {
+		deadLetter.Header.Del(natsMsgIdHeader)
+		deadLetter.Header.Set(deadLetterMsgIdHeader, msgId)
+	}
+	deadLetter.Header.Set(deadLetterSubjectHeader, msg.Subject)
+	deadLetter.Header.Set(deadLetterReasonHeader, response.Error.Message)
+	deadLetter.Header.Set(deadLetterErrorCodeHeader, response.Error.Code)
+	deadLetter.Header.Set(deadLetterHandlerHeader, handler)
+	deadLetter.Header.Set(deadLetterAttemptsHeader, strconv.FormatUint(attempts, 10))
+	deadLetter.Header.Set(deadLetterRequestIdHeader, response.RequestId)
+	deadLetter.Header.Set(deadLetterTimeHeader, time.Now().UTC().Format(time.RFC3339))
+
+	logger = logger.WithFields(log.Fields{
+		"dead_letter_subject": d.options.Subject,
+		"handler":             handler,
+		"attempts":            attempts,
+	})
+
+	var err error
+	if d.js != nil {
+		err = d.publisher.PublishMsgToStream(ctx, d.js, deadLetter)
+	} else {
+		err = d.publisher.PublishMsg(ctx, deadLetter)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to publish dead letter")
+		return err
+	}
+	logger.Warn("Message sent to dead letter subject")
+	return nil
+}
+
+// replay republishes the dead letters stored when it starts to their original subject, without the
+// dead letter headers (the original Nats-Msg-Id included, so the replay is not de-duplicated), and
+// removes them from the (work queue) dead letter stream. The replayed messages continue the trace of
+// the failed processing; those failing again are dead lettered anew and left for the next replay.
+func (d *deadLetterPublisher) replay() (int, error) {
+	logger := d.logger
+	if d.js == nil {
+		return 0, errors.New("replay requires a dead letter stream")
+	}
+
+	info, err := d.js.StreamInfo(d.options.Stream)
+	if err != nil {
+		return 0, err
+	}
+	lastSequence := info.State.LastSeq
+
+	subscription, err := d.js.PullSubscribe(d.options.Subject, "", nats.BindStream(d.options.Stream), nats.AckExplicit())
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = subscription.Unsubscribe()
+	}()
+
+	replayed := 0
+	for {
+		messages, err := subscription.Fetch(10, nats.MaxWait(d.options.ReplayWait))
+		if errors.Is(err, nats.ErrTimeout) {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		for _, deadLetter := range messages {
+			if storedAfter(deadLetter, lastSequence) {
+				_ = deadLetter.Nak()
+				return replayed, nil
+			}
+
+			msg := newReplayMsg(deadLetter)
+			if msg == nil {
+				logger.WithField("headers", deadLetter.Header).Error("Dead letter without original subject, discarding it")
+				_ = deadLetter.Term()
+				continue
+			}
+
+			ctx := otel.GetTextMapPropagator().Extract(context.Background(), NatsHeaderCarrier(deadLetter.Header))
+			err = d.publisher.PublishMsg(ctx, msg)
+			if err != nil {
+				logger.WithError(err).WithField("subject", msg.Subject).Error("Failed to replay dead letter")
+				_ = deadLetter.Nak()
+				return replayed, err
+			}
+			err = deadLetter.Ack()
+			if err != nil {
+				logger.WithError(err).WithField("subject", msg.Subject).Error("Failed to remove replayed dead letter")
+				return replayed, err
+			}
+
+			logger.WithFields(log.Fields{
+				"subject":    msg.Subject,
+				"request_id": deadLetter.Header.Get(deadLetterRequestIdHeader),
+			}).Info("Dead letter replayed")
+			replayed++
+		}
+	}
+}
+
+// storedAfter tells if a dead letter was stored after the given stream sequence, the replay stops at the
+// dead letters of the replayed messages failing again
+func storedAfter(deadLetter *nats.Msg, sequence uint64) bool {
+	metadata, err := deadLetter.Metadata()
+	return err == nil && metadata.Sequence.Stream > sequence
+}
+
+// newReplayMsg rebuilds the original message of a dead letter, nil when its subject is unknown
+func newReplayMsg(deadLetter *nats.Msg) *nats.Msg {
+	subject := deadLetter.Header.Get(deadLetterSubjectHeader)
+	if subject == "" {
+		return nil
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = deadLetter.Data
+	for key, values := range deadLetter.Header {
+		if !strings.HasPrefix(key, deadLetterHeaderPrefix) {
+			msg.Header[key] = values
+		}
+	}
+	return msg
+}
@@ -0,0 +1,160 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestDeadLetterPublisher(t *testing.T, sent *sentMessages) *deadLetterPublisher {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	tracer, _ := newTestTracer(t)
+	return &deadLetterPublisher{
+		logger:    log.NewEntry(logger),
+		options:   DeadLetterOptions{Enabled: true, Subject: "dead"},
+		publisher: &TracedPublisher{send: sent.send, tracer: tracer},
+	}
+}
+
+func newFailedMsg(msgId string) *nats.Msg {
+	msg := nats.NewMsg("create")
+	msg.Data = []byte(`{"key":""}`)
+	msg.Header.Set(versionHeader, MessageVersionV2)
+	if msgId != "" {
+		msg.Header.Set(natsMsgIdHeader, msgId)
+	}
+	return msg
+}
+
+func TestDeadLetterPublish(t *testing.T) {
+	tests := []struct {
+		name      string
+		msgId     string
+		wantMsgId string
+	}{
+		{name: "with message id", msgId: "id-1", wantMsgId: "id-1"},
+		{name: "without message id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sent := &sentMessages{}
+			publisher := newTestDeadLetterPublisher(t, sent)
+			msg := newFailedMsg(test.msgId)
+			response := newErrorResponse(ErrorCodeInvalidMessage, errors.New("key is required"))
+			response.RequestId = "request-1"
+
+			err := publisher.publish(context.Background(), publisher.logger, msg, "create-record", response, 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			deadLetters := sent.bySubject("dead")
+			if len(deadLetters) != 1 {
+				t.Fatalf("got %d dead letters, want 1", len(deadLetters))
+			}
+			deadLetter := deadLetters[0]
+			if string(deadLetter.Data) != string(msg.Data) || deadLetter.Header.Get(versionHeader) != MessageVersionV2 {
+				t.Error("dead letter without the original payload and headers")
+			}
+			// the streams would drop the dead letter as a duplicate of the original
+			if deadLetter.Header.Get(natsMsgIdHeader) != "" || deadLetter.Header.Get(deadLetterMsgIdHeader) != test.wantMsgId {
+				t.Errorf("got message id %q and dead letter message id %q, want only the dead letter one %q",
+					deadLetter.Header.Get(natsMsgIdHeader), deadLetter.Header.Get(deadLetterMsgIdHeader), test.wantMsgId)
+			}
+			if msg.Header.Get(natsMsgIdHeader) != test.msgId {
+				t.Error("original message headers changed")
+			}
+			wantHeaders := map[string]string{
+				deadLetterSubjectHeader:   "create",
+				deadLetterReasonHeader:    "key is required",
+				deadLetterErrorCodeHeader: ErrorCodeInvalidMessage,
+				deadLetterHandlerHeader:   "create-record",
+				deadLetterAttemptsHeader:  "3",
+				deadLetterRequestIdHeader: "request-1",
+			}
+			for header, want := range wantHeaders {
+				if got := deadLetter.Header.Get(header); got != want {
+					t.Errorf("got %s %q, want %q", header, got, want)
+				}
+			}
+			if _, err := time.Parse(time.RFC3339, deadLetter.Header.Get(deadLetterTimeHeader)); err != nil {
+				t.Errorf("invalid %s: %v", deadLetterTimeHeader, err)
+			}
+			if deadLetter.Header.Get("traceparent") == "" {
+				t.Error("dead letter without trace context")
+			}
+		})
+	}
+}
+
+func TestDeadLetterPublishFailure(t *testing.T) {
+	sendErr := errors.New("connection closed")
+	publisher := newTestDeadLetterPublisher(t, &sentMessages{err: sendErr})
+	response := newErrorResponse(ErrorCodeInvalidMessage, errors.New("key is required"))
+
+	err := publisher.publish(context.Background(), publisher.logger, newFailedMsg(""), "create-record", response, 1)
+	if !errors.Is(err, sendErr) {
+		t.Errorf("got %v, want %v", err, sendErr)
+	}
+}
+
+func TestNewReplayMsg(t *testing.T) {
+	sent := &sentMessages{}
+	publisher := newTestDeadLetterPublisher(t, sent)
+	msg := newFailedMsg("id-1")
+	msg.Header.Set(KarateTestIdAttribute, "test-1")
+	response := newErrorResponse(ErrorCodeRepositoryFailure, errors.New("throttled"))
+	err := publisher.publish(context.Background(), publisher.logger, msg, "create-record", response, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deadLetter := sent.bySubject("dead")[0]
+
+	replay := newReplayMsg(deadLetter)
+	if replay == nil || replay.Subject != "create" || string(replay.Data) != string(msg.Data) {
+		t.Fatalf("got %v, want the original message", replay)
+	}
+	// the original message id is dropped too, so the stream does not de-duplicate the replay
+	wantHeaders := nats.Header{
+		versionHeader:         []string{MessageVersionV2},
+		KarateTestIdAttribute: []string{"test-1"},
+		"traceparent":         deadLetter.Header.Values("traceparent"),
+	}
+	if !maps.EqualFunc(replay.Header, wantHeaders, slices.Equal) {
+		t.Errorf("got headers %v, want %v", replay.Header, wantHeaders)
+	}
+
+	deadLetter.Header.Del(deadLetterSubjectHeader)
+	if replay := newReplayMsg(deadLetter); replay != nil {
+		t.Errorf("got %v, want no replay without the original subject", replay)
+	}
+}
+
+func TestStoredAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  bool
+	}{
+		{name: "stored before", reply: "$JS.ACK.DEAD.replay.1.5.5.1717236000000000000.2", want: false},
+		{name: "last stored", reply: "$JS.ACK.DEAD.replay.1.10.10.1717236000000000000.0", want: false},
+		{name: "stored after", reply: "$JS.ACK.DEAD.replay.1.11.11.1717236000000000000.0", want: true},
+		{name: "not a JetStream message", reply: "_INBOX.1", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deadLetter := &nats.Msg{Subject: "dead", Reply: test.reply, Sub: &nats.Subscription{}}
+			if got := storedAfter(deadLetter, 10); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
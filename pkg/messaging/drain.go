@@ -0,0 +1,105 @@
+package messaging
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	drainPollInterval = 50 * time.Millisecond
+	replyFlushTimeout = 5 * time.Second
+)
+
+// drain stops receiving messages and waits, until the context is done, for the ones already received
+// to be processed and their replies sent. The messages that could not be processed in time are reported.
+func (n *NatsMessageProcessor) drain(ctx context.Context) {
+	logger := n.logger.WithField("drain_timeout", n.options.DrainTimeout.String())
+	started := time.Now()
+	logger.Info("Draining NATS subscriptions...")
+
+	// core subscriptions are unsubscribed and deliver what they buffered. The JetStream subscriptions are
+	// neither drained nor unsubscribed, both delete the durable consumers the subscriptions created: the
+	// fetches stop and the late push deliveries are nak'ed by the closed pools, to be redelivered to
+	// another instance.
+	closed := n.connection.IsClosed()
+	switch {
+	case n.jetStream != nil:
+		if !n.jetStream.shutdown(ctx) {
+			// the fetch loops are blocked on full pools, stopping the pools rejects their messages
+			for _, s := range n.subscriptions {
+				s.pool.shutdown()
+			}
+		}
+	case closed:
+		logger.Warn("NATS connection already closed, only the queued messages are processed")
+	default:
+		for _, s := range n.subscriptions {
+			err := s.subscription.Drain()
+			if err != nil {
+				logger.WithError(err).WithField("subject", s.subject).Error("Failed to drain subscription")
+			}
+		}
+		n.waitSubscriptionsDrained(ctx)
+	}
+
+	abandoned := map[string]int64{}
+	total := int64(0)
+	for _, s := range n.subscriptions {
+		count := s.pool.drain(ctx)
+		// the pull subscriptions only hold the fetch statuses, their messages went to the pool
+		if pending, _, err := s.subscription.Pending(); err == nil && s.subscription.Type() == nats.AsyncSubscription {
+			count += int64(pending)
+		}
+		if count > 0 {
+			abandoned[s.subject] = count
+			total += count
+		}
+	}
+	n.subscriptionsMu.Lock()
+	n.subscriptions = nil
+	n.subscriptionsMu.Unlock()
+
+	if !closed {
+		err := n.connection.FlushTimeout(replyFlushTimeout)
+		if err != nil {
+			logger.WithError(err).Error("Failed to flush the replies")
+		}
+	}
+
+	logger = logger.WithField("duration", time.Since(started).String())
+	if total > 0 {
+		logger.WithFields(log.Fields{
+			"abandoned":       abandoned,
+			"abandoned_total": total,
+		}).Warn("Drain deadline reached, messages abandoned")
+		return
+	}
+	logger.Info("Successful drain, all received messages processed")
+}
+
+// waitSubscriptionsDrained waits until the drained subscriptions delivered all their messages and closed
+func (n *NatsMessageProcessor) waitSubscriptionsDrained(ctx context.Context) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		draining := false
+		for _, s := range n.subscriptions {
+			if s.subscription.IsValid() {
+				draining = true
+				break
+			}
+		}
+		if !draining {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
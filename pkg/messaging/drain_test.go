@@ -0,0 +1,133 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"maps"
+	"testing"
+	"time"
+)
+
+// newClosedConnection is a connection closed before it ever reached a server
+func newClosedConnection(t *testing.T) *nats.Conn {
+	t.Helper()
+	connection, err := nats.Connect("nats://127.0.0.1:1", nats.RetryOnFailedConnect(true), nats.MaxReconnects(0))
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	connection.Close()
+	return connection
+}
+
+func TestDrainReportsAbandonedMessages(t *testing.T) {
+	tests := []struct {
+		name          string
+		blocked       map[string]int
+		wantAbandoned map[string]int64
+	}{
+		{name: "all processed", blocked: map[string]int{"create": 0, "get": 0}},
+		{
+			name:          "deadline reached",
+			blocked:       map[string]int{"create": 3, "get": 0},
+			wantAbandoned: map[string]int64{"create": 3},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger, hook := logtest.NewNullLogger()
+			processor := &NatsMessageProcessor{
+				logger:     log.NewEntry(logger),
+				connection: newClosedConnection(t),
+				options:    ProcessorOptions{DrainTimeout: 50 * time.Millisecond},
+			}
+
+			release := make(chan struct{})
+			defer close(release)
+			for subject, blocked := range test.blocked {
+				started := make(chan struct{}, 1)
+				pool := newTestPool(t, func(*nats.Msg) {
+					if blocked > 0 {
+						started <- struct{}{}
+						<-release
+					}
+				}, WorkerOptions{Workers: 1, MaxInFlight: 3})
+				// a blocked worker takes the first message, the others stay queued
+				for i := range max(blocked, 2) {
+					pool.dispatch(newOrderedMsg(t, orderedMessage{Key: fmt.Sprintf("key%d", i)}))
+				}
+				if blocked > 0 {
+					<-started
+				}
+				processor.subscriptions = append(processor.subscriptions, &processorSubscription{
+					subject:      subject,
+					subscription: &nats.Subscription{},
+					pool:         pool,
+				})
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), processor.options.DrainTimeout)
+			defer cancel()
+			processor.drain(ctx)
+
+			if len(processor.Subscriptions()) != 0 {
+				t.Error("subscriptions kept after the drain")
+			}
+			entry := hook.LastEntry()
+			if test.wantAbandoned == nil {
+				if entry.Level != log.InfoLevel || entry.Data["abandoned"] != nil {
+					t.Errorf("got %s log %q, want a successful drain", entry.Level, entry.Message)
+				}
+				return
+			}
+			abandoned, _ := entry.Data["abandoned"].(map[string]int64)
+			if entry.Level != log.WarnLevel || !maps.Equal(abandoned, test.wantAbandoned) {
+				t.Errorf("got %s log %q with %v abandoned, want %v", entry.Level, entry.Message, entry.Data["abandoned"], test.wantAbandoned)
+			}
+			total := int64(0)
+			for _, count := range test.wantAbandoned {
+				total += count
+			}
+			if entry.Data["abandoned_total"] != total {
+				t.Errorf("got %v abandoned in total, want %d", entry.Data["abandoned_total"], total)
+			}
+		})
+	}
+}
+
+func TestDrainStopsJetStreamFetches(t *testing.T) {
+	logger, _ := logtest.NewNullLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	jetStream := &jetStreamConsumer{logger: log.NewEntry(logger), ctx: ctx, cancel: cancel}
+	jetStream.fetches.Add(1)
+	go func() {
+		defer jetStream.fetches.Done()
+		<-jetStream.ctx.Done()
+	}()
+
+	pool := newTestPool(t, func(*nats.Msg) {}, WorkerOptions{Workers: 1, MaxInFlight: 1})
+	var rejected []*nats.Msg
+	pool.reject = func(msg *nats.Msg) { rejected = append(rejected, msg) }
+	processor := &NatsMessageProcessor{
+		logger:        log.NewEntry(logger),
+		connection:    newClosedConnection(t),
+		jetStream:     jetStream,
+		subscriptions: []*processorSubscription{{subject: "create", subscription: &nats.Subscription{}, pool: pool}},
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Second)
+	defer drainCancel()
+	processor.drain(drainCtx)
+
+	if jetStream.ctx.Err() == nil {
+		t.Error("fetches not stopped")
+	}
+	// a push delivery after the drain is handed back to the stream
+	late := newOrderedMsg(t, orderedMessage{Key: "late"})
+	pool.dispatch(late)
+	if len(rejected) != 1 || rejected[0] != late {
+		t.Errorf("got %d messages rejected, want the late delivery", len(rejected))
+	}
+}
@@ -0,0 +1,99 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"log-trace-testing/pkg/db"
+	"time"
+)
+
+const (
+	RecordCreatedEvent = "record.created"
+	RecordUpdatedEvent = "record.updated"
+	RecordDeletedEvent = "record.deleted"
+)
+
+const eventTypeHeader = "Event-Type"
+
+type EventSubjects struct {
+	Created string
+	Updated string
+	Deleted string
+}
+
+type EventOptions struct {
+	Enabled  bool
+	Subjects EventSubjects
+}
+
+type RecordEvent struct {
+	Type      string    `json:"type"`
+	Namespace string    `json:"namespace"`
+	Key       string    `json:"key"`
+	Info      string    `json:"info,omitempty"`
+	Version   int64     `json:"version,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	RequestId string    `json:"requestId"`
+}
+
+func newRecordEvent(eventType string, record db.Record) *RecordEvent {
+	return &RecordEvent{
+		Type:      eventType,
+		Namespace: record.Namespace,
+		Key:       record.Key,
+		Info:      record.Info,
+		Version:   record.Version,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+type eventPublisher struct {
+	options   EventOptions
+	publisher *TracedPublisher
+}
+
+func newEventPublisher(publisher *TracedPublisher, options EventOptions) *eventPublisher {
+	return &eventPublisher{
+		options:   options,
+		publisher: publisher,
+	}
+}
+
+func (e *eventPublisher) subject(eventType string) string {
+	switch eventType {
+	case RecordCreatedEvent:
+		return e.options.Subjects.Created
+	case RecordUpdatedEvent:
+		return e.options.Subjects.Updated
+	case RecordDeletedEvent:
+		return e.options.Subjects.Deleted
+	}
+	return ""
+}
+
+// publish sends the event of a successful write. A failed publish is only logged: the write is
+// already done and processing the message again would not bring the event back.
+func (e *eventPublisher) publish(ctx context.Context, logger *log.Entry, event *RecordEvent) {
+	logger = logger.WithFields(log.Fields{
+		"event_type":    event.Type,
+		"event_subject": e.subject(event.Type),
+	})
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.WithError(err).Error("Failed to serialize event")
+		return
+	}
+
+	msg := nats.NewMsg(e.subject(event.Type))
+	msg.Data = data
+	msg.Header.Set(eventTypeHeader, event.Type)
+	err = e.publisher.PublishMsg(ctx, msg)
+	if err != nil {
+		logger.WithError(err).Error("Failed to publish event")
+		return
+	}
+	logger.Info("Event published")
+}
@@ -0,0 +1,131 @@
+package messaging
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"log-trace-testing/pkg/db"
+	"testing"
+)
+
+var testEventOptions = EventOptions{
+	Enabled: true,
+	Subjects: EventSubjects{
+		Created: "events.created",
+		Updated: "events.updated",
+		Deleted: "events.deleted",
+	},
+}
+
+func TestMessageHandlerPublishesEvents(t *testing.T) {
+	tests := []struct {
+		name        string
+		msg         func(t *testing.T) *nats.Msg
+		wantType    string
+		wantSubject string
+		wantVersion int64
+	}{
+		{
+			name: "created",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "create", CreateMessage{Namespace: "tenant", Key: "new", Info: "info"})
+			},
+			wantType:    RecordCreatedEvent,
+			wantSubject: "events.created",
+			wantVersion: 1,
+		},
+		{
+			name: "updated",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "update", UpdateMessage{Namespace: "tenant", Key: "key", Info: "info"})
+			},
+			wantType:    RecordUpdatedEvent,
+			wantSubject: "events.updated",
+			wantVersion: 2,
+		},
+		{
+			name: "deleted",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "delete", DeleteMessage{Namespace: "tenant", Key: "key"})
+			},
+			wantType:    RecordDeletedEvent,
+			wantSubject: "events.deleted",
+		},
+		{
+			name: "missing record deleted",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "delete", DeleteMessage{Namespace: "tenant", Key: "missing"})
+			},
+		},
+		{
+			name: "failed write",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "create", CreateMessage{Namespace: "tenant", Key: "key", Info: "info"})
+			},
+		},
+		{
+			name: "read",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "get", GetMessage{Namespace: "tenant", Key: "key"})
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := ProcessorOptions{Events: testEventOptions}
+			processor := newTestProcessor(t, options, nil, db.Record{Namespace: "tenant", Key: "key", Info: "old"})
+
+			processor.messageHandler(test.msg(t))
+
+			// the response is the only other message sent
+			sent := processor.sent.messages
+			var events []*nats.Msg
+			for _, msg := range sent {
+				if msg.Subject != testReplySubject {
+					events = append(events, msg)
+				}
+			}
+			if test.wantType == "" {
+				if len(events) != 0 {
+					t.Fatalf("got %d events, want none", len(events))
+				}
+				return
+			}
+			if len(events) != 1 || events[0].Subject != test.wantSubject {
+				t.Fatalf("got %d events, want one on %s", len(events), test.wantSubject)
+			}
+			msg := events[0]
+			if eventType := msg.Header.Get(eventTypeHeader); eventType != test.wantType {
+				t.Errorf("got event type header %q, want %q", eventType, test.wantType)
+			}
+			if msg.Header.Get("traceparent") == "" {
+				t.Error("event without trace context")
+			}
+
+			var event RecordEvent
+			err := json.Unmarshal(msg.Data, &event)
+			if err != nil {
+				t.Fatalf("unmarshal event %q: %v", msg.Data, err)
+			}
+			responses := processor.responses(t)
+			if len(responses) != 1 {
+				t.Fatalf("got %d responses, want 1", len(responses))
+			}
+			if event.Type != test.wantType || event.Namespace != "tenant" || event.Version != test.wantVersion {
+				t.Errorf("got event %+v, want a %s event of version %d", event, test.wantType, test.wantVersion)
+			}
+			if event.RequestId != responses[0].RequestId || event.Timestamp.IsZero() {
+				t.Errorf("got request id %q and timestamp %v, want the request id of the response", event.RequestId, event.Timestamp)
+			}
+		})
+	}
+}
+
+func TestMessageHandlerWithoutEvents(t *testing.T) {
+	processor := newTestProcessor(t, ProcessorOptions{}, nil)
+
+	processor.messageHandler(newTestRequest(t, "create", CreateMessage{Namespace: "tenant", Key: "key"}))
+
+	if sent := len(processor.sent.messages); sent != 1 {
+		t.Errorf("got %d messages sent, want only the response", sent)
+	}
+}
@@ -0,0 +1,101 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log-trace-testing/pkg/db"
+)
+
+const (
+	natsMsgIdHeader      = "Nats-Msg-Id"
+	idempotencyKeyHeader = "idempotency-key"
+)
+
+// idempotencyKey identifies a message among its retries and redeliveries, scoped by subject
+// since the same id on another subject is another operation. Empty when the publisher sets no id.
+func idempotencyKey(msg *nats.Msg) string {
+	id := msg.Header.Get(natsMsgIdHeader)
+	if id == "" {
+		id = msg.Header.Get(idempotencyKeyHeader)
+	}
+	if id == "" {
+		return ""
+	}
+	return msg.Subject + "/" + id
+}
+
+// idempotencyReservation is the claim of a message on its idempotency key while it is processed
+type idempotencyReservation struct {
+	key   string
+	token string
+}
+
+// reserve claims the idempotency key of a message before it is processed. It returns the response to send
+// instead of processing the message: the stored one of an already processed message, or IN_PROGRESS while
+// a duplicate is processed. The reservation is nil when the message is processed without one.
+func (n *NatsMessageProcessor) reserve(ctx context.Context, logger *log.Entry, key string) (*Response, *idempotencyReservation) {
+	if n.idempotencyStore == nil || key == "" {
+		return nil, nil
+	}
+
+	reservation := &idempotencyReservation{key: key, token: uuid.NewString()}
+	data, err := n.idempotencyStore.Reserve(ctx, key, reservation.token)
+	if errors.Is(err, db.ErrIdempotencyKeyInProgress) {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("idempotency.in_progress", true))
+		logger.Info("Message with the same idempotency key is being processed")
+		return newErrorResponse(ErrorCodeInProgress, err), nil
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to reserve idempotency key, processing the message")
+		return nil, nil
+	}
+	if data == nil {
+		return nil, reservation
+	}
+
+	response := &Response{}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to decode stored response, processing the message")
+		return nil, nil
+	}
+	response.Replayed = true
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("idempotency.replayed", true))
+	logger.WithField("original_request_id", response.RequestId).Info("Message already processed, replaying its response")
+	return response, nil
+}
+
+// complete keeps the outcome of a processed message under its reservation. Repository failures are not
+// kept, the reservation is released so that the message is processed again when it is retried.
+func (n *NatsMessageProcessor) complete(ctx context.Context, logger *log.Entry, reservation *idempotencyReservation, response *Response) {
+	if reservation == nil {
+		return
+	}
+	if response.IsError() && response.Error.Code == ErrorCodeRepositoryFailure {
+		err := n.idempotencyStore.Release(ctx, reservation.key, reservation.token)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to release idempotency key")
+		}
+		return
+	}
+
+	data, err := serializeResponse(response)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to serialize response for the idempotency store")
+		return
+	}
+	err = n.idempotencyStore.Complete(ctx, reservation.key, reservation.token, data)
+	if errors.Is(err, db.ErrIdempotencyReservationLost) {
+		logger.Warn("Idempotency key reservation expired while processing the message, response not saved")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to save response in the idempotency store")
+	}
+}
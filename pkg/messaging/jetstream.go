@@ -0,0 +1,291 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JetStreamOptions struct {
+	Enabled bool
+	// stream capturing all the processor subjects, created (or updated) on Init
+	Stream string
+	// prefix of the durable consumers, one consumer is created per subject
+	Durable string
+	// pull consumers are fetched by the processor, push consumers are delivered by the server
+	Pull       bool
+	FetchBatch int
+	FetchWait  time.Duration
+	AckWait    time.Duration
+	MaxDeliver int
+	// delay before a message that failed on the repository is redelivered
+	NakDelay time.Duration
+}
+
+// consumer names cannot have the subject separators and wildcards
+var consumerNameReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_")
+
+func (o JetStreamOptions) consumerName(subject string) string {
+	return fmt.Sprintf("%s-%s", o.Durable, consumerNameReplacer.Replace(subject))
+}
+
+type jetStreamConsumer struct {
+	logger  *log.Entry
+	options JetStreamOptions
+	js      nats.JetStreamContext
+	// the capacity of a worker pool: the server delivers no more messages than the pool holds, so none
+	// of them waits in the pool past the ack wait
+	maxAckPending int
+	// cancelled on shutdown, it interrupts the pending fetches
+	ctx     context.Context
+	cancel  context.CancelFunc
+	fetches sync.WaitGroup
+}
+
+func newJetStreamConsumer(logger *log.Entry, connection *nats.Conn, options JetStreamOptions, maxAckPending int) (*jetStreamConsumer, error) {
+	js, err := connection.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jetStreamConsumer{
+		logger: logger.WithFields(log.Fields{
+			"stream": options.Stream,
+			"pull":   options.Pull,
+		}),
+		options:       options,
+		js:            js,
+		maxAckPending: maxAckPending,
+		ctx:           ctx,
+		cancel:        cancel,
+	}, nil
+}
+
+func (j *jetStreamConsumer) provisionStream(subjects []string) error {
+	logger := j.logger.WithField("subjects", subjects)
+
+	info, err := j.js.StreamInfo(j.options.Stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		logger.Info("Creating JetStream stream")
+		_, err = j.js.AddStream(&nats.StreamConfig{
+			Name:     j.options.Stream,
+			Subjects: subjects,
+			Storage:  nats.FileStorage,
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	missing := missingSubjects(info.Config.Subjects, subjects)
+	if len(missing) > 0 {
+		logger.WithField("missing", missing).Info("Adding subjects to the JetStream stream")
+		config := info.Config
+		// the subjects added to the stream by others are kept
+		config.Subjects = append(slices.Clone(info.Config.Subjects), missing...)
+		_, err = j.js.UpdateStream(&config)
+		return err
+	}
+
+	logger.Info("JetStream stream already provisioned")
+	return nil
+}
+
+// missingSubjects returns the subjects not captured by the stream yet
+func missingSubjects(streamSubjects []string, subjects []string) []string {
+	var missing []string
+	for _, subject := range subjects {
+		if !slices.Contains(streamSubjects, subject) && !slices.Contains(missing, subject) {
+			missing = append(missing, subject)
+		}
+	}
+	return missing
+}
+
+// subscribe binds the durable consumer of the subject. Push consumers are delivered to the queue group (if
+// any) so each message goes to one instance, the instances fetching from a pull consumer already share it.
+func (j *jetStreamConsumer) subscribe(subject string, queueGroup string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	consumer := j.options.consumerName(subject)
+	logger := j.logger.WithFields(log.Fields{
+		"subject":     subject,
+		"consumer":    consumer,
+		"queue_group": queueGroup,
+	})
+
+	err := j.provisionConsumer(logger, consumer)
+	if err != nil {
+		return nil, err
+	}
+
+	subOpts := []nats.SubOpt{
+		nats.BindStream(j.options.Stream),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(j.options.AckWait),
+		nats.MaxDeliver(j.options.MaxDeliver),
+		nats.MaxAckPending(j.maxAckPending),
+		nats.DeliverAll(),
+	}
+
+	if !j.options.Pull {
+		logger.Info("Subscribing durable push consumer")
+		subOpts = append(subOpts, nats.Durable(consumer))
+		if queueGroup != "" {
+			return j.js.QueueSubscribe(subject, queueGroup, handler, subOpts...)
+		}
+		return j.js.Subscribe(subject, handler, subOpts...)
+	}
+
+	logger.Info("Subscribing durable pull consumer")
+	subscription, err := j.js.PullSubscribe(subject, consumer, subOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	j.fetches.Add(1)
+	go j.fetchLoop(logger, subscription, handler)
+
+	return subscription, nil
+}
+
+// provisionConsumer updates the max ack pending of an existing durable consumer, binding a consumer with
+// another value fails. Missing consumers are created by the subscription.
+func (j *jetStreamConsumer) provisionConsumer(logger *log.Entry, consumer string) error {
+	info, err := j.js.ConsumerInfo(j.options.Stream, consumer)
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Config.MaxAckPending == j.maxAckPending {
+		return nil
+	}
+
+	logger.WithFields(log.Fields{
+		"from": info.Config.MaxAckPending,
+		"to":   j.maxAckPending,
+	}).Info("Updating JetStream consumer max ack pending")
+	config := info.Config
+	config.MaxAckPending = j.maxAckPending
+	_, err = j.js.UpdateConsumer(j.options.Stream, &config)
+	return err
+}
+
+func (j *jetStreamConsumer) fetchLoop(logger *log.Entry, subscription *nats.Subscription, handler nats.MsgHandler) {
+	defer j.fetches.Done()
+
+	for {
+		if j.ctx.Err() != nil {
+			logger.Info("Stopping JetStream fetch loop")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(j.ctx, j.options.FetchWait)
+		messages, err := subscription.Fetch(j.options.FetchBatch, nats.Context(ctx))
+		cancel()
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				continue
+			}
+			if errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrBadSubscription) {
+				logger.WithError(err).Warn("JetStream subscription closed, stopping fetch loop")
+				return
+			}
+			logger.WithError(err).Error("Failed to fetch JetStream messages")
+			continue
+		}
+
+		for _, msg := range messages {
+			handler(msg)
+		}
+	}
+}
+
+// inProgress restarts the ack wait of a message taken by a worker, the time it waited in the pool does not count
+func (j *jetStreamConsumer) inProgress(logger *log.Entry, msg *nats.Msg) {
+	err := msg.InProgress()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to mark JetStream message in progress")
+	}
+}
+
+// reject redelivers a message the worker pools did not take, instead of waiting for its ack wait. The delay keeps
+// a push consumer from delivering it straight back to this instance, until the connection is closed.
+func (j *jetStreamConsumer) reject(msg *nats.Msg) {
+	err := msg.NakWithDelay(j.options.NakDelay)
+	if err != nil {
+		j.logger.WithError(err).Warn("Failed to nak rejected JetStream message")
+	}
+}
+
+// shutdown stops the fetches and waits, until the context is done, for the fetch loops to hand their
+// last messages to the worker pools. It returns false when a fetch loop is still running.
+func (j *jetStreamConsumer) shutdown(ctx context.Context) bool {
+	j.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		j.fetches.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// settle acknowledges a JetStream message according to the processing outcome:
+// success (or an expected failure, like a missing record) is acked, a duplicate of a message still being
+// processed is redelivered later to get its response, a repository failure is redelivered after a delay until the max deliveries
+// are reached and a message that can never be processed (invalid payload, unknown subject) is
+// terminated. Terminated messages are handed to deadLetter first, and redelivered if it fails, except the
+// replayed error of a duplicate: the original message was already dead lettered.
+func (j *jetStreamConsumer) settle(logger *log.Entry, msg *nats.Msg, response *Response, deadLetter func(attempts uint64) error) {
+	attempts := uint64(1)
+	metadata, err := msg.Metadata()
+	if err == nil {
+		attempts = metadata.NumDelivered
+	}
+
+	var action string
+	switch {
+	case !response.IsError() || response.isExpectedFailure():
+		action = "ack"
+		err = msg.Ack()
+	case response.isInProgress():
+		action = "nak"
+		err = msg.NakWithDelay(j.options.NakDelay)
+	case response.Replayed:
+		action = "term"
+		err = msg.Term()
+	case response.Error.Code == ErrorCodeRepositoryFailure && attempts < uint64(j.options.MaxDeliver):
+		action = "nak"
+		err = msg.NakWithDelay(j.options.NakDelay)
+	case deadLetter(attempts) != nil:
+		action = "nak"
+		err = msg.NakWithDelay(j.options.NakDelay)
+	default:
+		action = "term"
+		err = msg.Term()
+	}
+
+	logger = logger.WithFields(log.Fields{
+		"ack_action": action,
+		"attempts":   attempts,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to acknowledge JetStream message")
+		return
+	}
+	logger.Info("JetStream message acknowledged")
+}
@@ -0,0 +1,27 @@
+package messaging
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMissingSubjects(t *testing.T) {
+	tests := []struct {
+		name           string
+		streamSubjects []string
+		subjects       []string
+		want           []string
+	}{
+		{name: "all captured", streamSubjects: []string{"create", "get", "other"}, subjects: []string{"create", "get"}},
+		{name: "new subject", streamSubjects: []string{"create", "other"}, subjects: []string{"create", "get"}, want: []string{"get"}},
+		{name: "empty stream", subjects: []string{"create", "get"}, want: []string{"create", "get"}},
+		{name: "duplicated subject", streamSubjects: []string{"other"}, subjects: []string{"create", "create"}, want: []string{"create"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := missingSubjects(test.streamSubjects, test.subjects); !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -2,48 +2,197 @@ package messaging
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/nats-io/nats.go"
+	"log-trace-testing/pkg/db"
 )
 
+// namespace used by publishers that still send messages without one
+const defaultNamespace = "default"
+
 type CreateMessage struct {
-	Key  string `json:"key"`
-	Info string `json:"info"`
+	Namespace string `json:"namespace" validate:"required,max=64,pattern=namespace"`
+	Key       string `json:"key" validate:"required,max=512,pattern=key"`
+	Info      string `json:"info" validate:"max=4096"`
+	// replace an existing record instead of failing with a conflict
+	Overwrite bool `json:"overwrite,omitempty"`
+}
+
+type GetMessage struct {
+	Namespace string `json:"namespace" validate:"required,max=64,pattern=namespace"`
+	Key       string `json:"key" validate:"required,max=512,pattern=key"`
 }
 
 type ListMessage struct {
-	Key string `json:"key"`
+	Namespace string `json:"namespace" validate:"required,max=64,pattern=namespace"`
+	// key prefix, empty to list the whole namespace
+	Key    string `json:"key" validate:"max=512,pattern=key"`
+	Limit  int32  `json:"limit,omitempty" validate:"min=0"`
+	Cursor string `json:"cursor,omitempty" validate:"max=2048"`
+}
+
+type UpdateMessage struct {
+	Namespace string `json:"namespace" validate:"required,max=64,pattern=namespace"`
+	Key       string `json:"key" validate:"required,max=512,pattern=key"`
+	Info      string `json:"info" validate:"max=4096"`
+	// when set, the record is only updated if its current info is this one
+	ExpectedInfo *string `json:"expectedInfo,omitempty"`
+	// when set, the record is only updated if its current version is this one
+	ExpectedVersion *int64 `json:"expectedVersion,omitempty" validate:"min=1"`
 }
 
 type DeleteMessage struct {
-	Key string `json:"key"`
+	Namespace string `json:"namespace" validate:"required,max=64,pattern=namespace"`
+	Key       string `json:"key" validate:"required,max=512,pattern=key"`
+	// when set, the record is only deleted if its current version is this one
+	ExpectedVersion *int64 `json:"expectedVersion,omitempty" validate:"min=1"`
 }
 
-func deserializeCreateMessage(msg *nats.Msg) (*CreateMessage, error) {
-	createMsg := &CreateMessage{}
-	err := json.Unmarshal(msg.Data, createMsg)
-	if err != nil {
-		return nil, err
+func namespaceOrDefault(namespace string) string {
+	if namespace == "" {
+		return defaultNamespace
 	}
+	return namespace
+}
 
-	return createMsg, nil
+func deserializeCreateMessage(msg *nats.Msg) (*CreateMessage, error) {
+	return createMessageCodecs.decode(msg)
+}
+
+func deserializeGetMessage(msg *nats.Msg) (*GetMessage, error) {
+	return getMessageCodecs.decode(msg)
 }
 
 func deserializeListMessage(msg *nats.Msg) (*ListMessage, error) {
-	listMsg := &ListMessage{}
-	err := json.Unmarshal(msg.Data, listMsg)
-	if err != nil {
-		return nil, err
-	}
+	return listMessageCodecs.decode(msg)
+}
 
-	return listMsg, nil
+func deserializeUpdateMessage(msg *nats.Msg) (*UpdateMessage, error) {
+	return updateMessageCodecs.decode(msg)
 }
 
 func deserializeDeleteMessage(msg *nats.Msg) (*DeleteMessage, error) {
-	deleteMsg := &DeleteMessage{}
-	err := json.Unmarshal(msg.Data, deleteMsg)
-	if err != nil {
-		return nil, err
+	return deleteMessageCodecs.decode(msg)
+}
+
+const (
+	ResponseStatusOk    = "ok"
+	ResponseStatusError = "error"
+)
+
+const (
+	ErrorCodeInvalidMessage     = "INVALID_MESSAGE"
+	ErrorCodeRepositoryFailure  = "REPOSITORY_FAILURE"
+	ErrorCodeUnknownSubject     = "UNKNOWN_SUBJECT"
+	ErrorCodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+	ErrorCodeNotFound           = "NOT_FOUND"
+	ErrorCodeConditionFailed    = "CONDITION_FAILED"
+	ErrorCodeConflict           = "CONFLICT"
+	ErrorCodeInProgress         = "IN_PROGRESS"
+)
+
+type ResponseError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+type Response struct {
+	Status    string         `json:"status"`
+	Error     *ResponseError `json:"error,omitempty"`
+	RequestId string         `json:"requestId"`
+	TraceId   string         `json:"traceId"`
+	Data      any            `json:"data,omitempty"`
+	// the message was already processed, this is the original response
+	Replayed bool `json:"replayed,omitempty"`
+	// published once the message is processed
+	event *RecordEvent
+}
+
+type CreateResult struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Version   int64  `json:"version"`
+}
+
+type GetResult struct {
+	Record db.Record `json:"record"`
+}
+
+type ListResult struct {
+	Records    []db.Record `json:"records"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+type UpdateResult struct {
+	Record db.Record `json:"record"`
+}
+
+type DeleteResult struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+}
+
+func newSuccessResponse(data any) *Response {
+	return &Response{
+		Status: ResponseStatusOk,
+		Data:   data,
+	}
+}
+
+func newErrorResponse(code string, err error) *Response {
+	return &Response{
+		Status: ResponseStatusError,
+		Error: &ResponseError{
+			Code:    code,
+			Message: err.Error(),
+		},
+	}
+}
+
+// newDeserializationErrorResponse rejects a message that could not be decoded or is not valid
+func newDeserializationErrorResponse(err error) *Response {
+	var versionErr *UnsupportedVersionError
+	if errors.As(err, &versionErr) {
+		return newErrorResponse(ErrorCodeUnsupportedVersion, err)
 	}
+	response := newErrorResponse(ErrorCodeInvalidMessage, err)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		response.Error.Fields = validationErr.Fields
+	}
+	return response
+}
+
+func (r *Response) withEvent(event *RecordEvent) *Response {
+	r.event = event
+	return r
+}
+
+func (r *Response) IsError() bool {
+	return r.Status == ResponseStatusError
+}
+
+// isExpectedFailure tells if an error response answers a valid request (missing record, failed condition,
+// version conflict), processing it again would give the same answer so it is neither redelivered nor
+// dead lettered
+func (r *Response) isExpectedFailure() bool {
+	if !r.IsError() {
+		return false
+	}
+	switch r.Error.Code {
+	case ErrorCodeNotFound, ErrorCodeConditionFailed, ErrorCodeConflict:
+		return true
+	}
+	return false
+}
+
+// isInProgress tells if the response answers a duplicate of a message still being processed, it must be
+// sent again later to get the response of the original
+func (r *Response) isInProgress() bool {
+	return r.IsError() && r.Error.Code == ErrorCodeInProgress
+}
 
-	return deleteMsg, nil
+func serializeResponse(response *Response) ([]byte, error) {
+	return json.Marshal(response)
 }
@@ -0,0 +1,95 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"time"
+)
+
+type processorMetrics struct {
+	received  metric.Int64Counter
+	processed metric.Int64Counter
+	failed    metric.Int64Counter
+	duration  metric.Float64Histogram
+	inFlight  metric.Int64UpDownCounter
+	// worker pools
+	queued       metric.Int64UpDownCounter
+	slowConsumer metric.Int64Counter
+	// connection
+	connectionEvents metric.Int64Counter
+}
+
+func newProcessorMetrics(meter metric.Meter) (*processorMetrics, error) {
+	received, err1 := meter.Int64Counter("messaging.messages.received",
+		metric.WithDescription("Messages received per subject"),
+		metric.WithUnit("{message}"))
+	processed, err2 := meter.Int64Counter("messaging.messages.processed",
+		metric.WithDescription("Messages successfully processed per subject"),
+		metric.WithUnit("{message}"))
+	failed, err3 := meter.Int64Counter("messaging.messages.failed",
+		metric.WithDescription("Messages that failed processing per subject and error code"),
+		metric.WithUnit("{message}"))
+	duration, err4 := meter.Float64Histogram("messaging.process.duration",
+		metric.WithDescription("Duration of the message handlers"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10))
+	inFlight, err5 := meter.Int64UpDownCounter("messaging.messages.in_flight",
+		metric.WithDescription("Messages being processed"),
+		metric.WithUnit("{message}"))
+
+	queued, err6 := meter.Int64UpDownCounter("messaging.messages.queued",
+		metric.WithDescription("Messages waiting for a worker per subject"),
+		metric.WithUnit("{message}"))
+	slowConsumer, err7 := meter.Int64Counter("messaging.slow_consumer.events",
+		metric.WithDescription("Subscriptions over their pending limits, dropping messages, per subject"),
+		metric.WithUnit("{event}"))
+
+	connectionEvents, err8 := meter.Int64Counter("messaging.connection.events",
+		metric.WithDescription("NATS connection lifecycle events (disconnected, reconnected, closed, slow_consumer, error)"),
+		metric.WithUnit("{event}"))
+
+	err := errors.Join(err1, err2, err3, err4, err5, err6, err7, err8)
+	if err != nil {
+		return nil, err
+	}
+
+	return &processorMetrics{
+		received:  received,
+		processed: processed,
+		failed:    failed,
+		duration:  duration,
+		inFlight:  inFlight,
+
+		queued:       queued,
+		slowConsumer: slowConsumer,
+
+		connectionEvents: connectionEvents,
+	}, nil
+}
+
+// start records a received message and returns the function recording its outcome
+func (m *processorMetrics) start(ctx context.Context, subject string) func(handler string, response *Response) {
+	started := time.Now()
+	subjectAttr := attribute.String("messaging.destination.name", subject)
+
+	m.received.Add(ctx, 1, metric.WithAttributes(subjectAttr))
+	m.inFlight.Add(ctx, 1, metric.WithAttributes(subjectAttr))
+
+	return func(handler string, response *Response) {
+		m.inFlight.Add(ctx, -1, metric.WithAttributes(subjectAttr))
+
+		attrs := []attribute.KeyValue{
+			subjectAttr,
+			attribute.String("handler", handler),
+			attribute.String("status", response.Status),
+		}
+		if response.IsError() {
+			m.failed.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.String("error.code", response.Error.Code))...))
+		} else {
+			m.processed.Add(ctx, 1, metric.WithAttributes(attrs...))
+		}
+		m.duration.Record(ctx, time.Since(started).Seconds(), metric.WithAttributes(attrs...))
+	}
+}
@@ -2,60 +2,177 @@ package messaging
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 	"log-trace-testing/pkg/db"
+	"sync"
+	"time"
 )
 
-const (
-	// subjects
-	createSubject = "create"
-	listSubject   = "list"
-	deleteSubject = "delete"
-	//
-	tableName = "my-table"
-)
+type Subjects struct {
+	Create string
+	Get    string
+	List   string
+	Update string
+	Delete string
+}
+
+func (s Subjects) all() []string {
+	return []string{s.Create, s.Get, s.List, s.Update, s.Delete}
+}
 
-var natsSubjects = []string{createSubject, listSubject, deleteSubject}
+type ProcessorOptions struct {
+	URL        string
+	Auth       AuthOptions
+	TLS        TLSOptions
+	Subjects   Subjects
+	JetStream  JetStreamOptions
+	DeadLetter DeadLetterOptions
+	Events     EventOptions
+	Workers    WorkerOptions
+	Reconnect  ReconnectOptions
+	// max wait on shutdown for the received messages to be processed
+	DrainTimeout time.Duration
+	// queue group of each subject, so a message is processed by a single instance of the group,
+	// subjects without one get a plain subscription
+	QueueGroups map[string]string
+}
+
+type messageProcessingFunc func(ctx context.Context, logger *log.Entry, repository db.Repository, msg *nats.Msg) *Response
+
+type subjectHandler struct {
+	name    string
+	process messageProcessingFunc
+}
+
+func newSubjectHandlers(subjects Subjects) map[string]subjectHandler {
+	return map[string]subjectHandler{
+		subjects.Create: {name: "create-record", process: processCreateMessage},
+		subjects.Get:    {name: "get-record", process: processGetMessage},
+		subjects.List:   {name: "list-records", process: processListMessage},
+		subjects.Update: {name: "update-record", process: processUpdateMessage},
+		subjects.Delete: {name: "delete-record", process: processDeleteMessage},
+	}
+}
 
 type MessageProcessor interface {
 	Init() bool
 	Shutdown() bool
 	Subscribe() bool
+	ReplayDeadLetters() bool
+	ConnectionState() ConnectionState
+	Subscriptions() []SubscriptionState
 }
 
 type NatsMessageProcessor struct {
-	logger     *log.Entry
-	connection *nats.Conn
-	tracer     trace.Tracer
+	logger            *log.Entry
+	connection        *nats.Conn
+	tracer            trace.Tracer
+	meter             metric.Meter
+	metrics           *processorMetrics
+	repositoryFactory db.RepositoryFactory
+	idempotencyStore  db.IdempotencyStore
+	options           ProcessorOptions
+	handlers          map[string]subjectHandler
+	publisher         *TracedPublisher
+	jetStream         *jetStreamConsumer
+	deadLetter        *deadLetterPublisher
+	events            *eventPublisher
+	subscriptions     []*processorSubscription
+	subscriptionsMu   sync.RWMutex
+	state             connectionState
 	// public
 	URL string
 }
 
-func NewNatsMessageProcessor(logger *log.Entry, tracer trace.Tracer, url string) *NatsMessageProcessor {
+// NewNatsMessageProcessor builds a processor, idempotencyStore is optional (nil to process every message)
+func NewNatsMessageProcessor(logger *log.Entry, tracer trace.Tracer, meter metric.Meter, repositoryFactory db.RepositoryFactory, idempotencyStore db.IdempotencyStore, options ProcessorOptions) *NatsMessageProcessor {
 	return &NatsMessageProcessor{
 		logger: logger.WithFields(log.Fields{
-			"cluster": url,
+			"cluster":   options.URL,
+			"auth":      options.Auth.Mode,
+			"tls":       options.TLS.Enabled,
+			"jetstream": options.JetStream.Enabled,
 		}),
-		URL:    url,
-		tracer: tracer,
+		URL:               options.URL,
+		tracer:            tracer,
+		meter:             meter,
+		repositoryFactory: repositoryFactory,
+		idempotencyStore:  idempotencyStore,
+		options:           options,
+		handlers:          newSubjectHandlers(options.Subjects),
 	}
 }
 
 func (n *NatsMessageProcessor) Init() bool {
 	logger := n.logger
 
+	metrics, err := newProcessorMetrics(n.meter)
+	if err != nil {
+		logger.WithError(err).Error("Failed to create processor metrics")
+		return false
+	}
+	n.metrics = metrics
+
+	connectOptions, err := n.options.connectOptions()
+	if err != nil {
+		logger.WithError(err).Error("Invalid NATS authentication or TLS options")
+		return false
+	}
+	connectOptions = append(connectOptions, n.options.Reconnect.connectOptions()...)
+	connectOptions = append(connectOptions, n.connectionHandlers()...)
+
 	logger.Info("Connecting to NATS server...")
-	con, err := nats.Connect(n.URL, nats.Token("s3cr3t"))
+	con, err := nats.Connect(n.URL, connectOptions...)
 	if err != nil {
+		if errors.Is(err, nats.ErrAuthorization) {
+			logger = logger.WithField("hint", n.options.Auth.authorizationHint())
+		}
 		logger.WithError(err).Error("Failed to connect to NATS server")
 		return false
 	}
 	logger.Info("Successful connected to NATS server...")
 	n.connection = con
+	n.state.connected(con)
+	err = n.observeConnection()
+	if err != nil {
+		logger.WithError(err).Error("Failed to create connection metrics")
+		return false
+	}
+	n.publisher = NewTracedPublisher(con, n.tracer)
+
+	if n.options.JetStream.Enabled {
+		jetStream, err := newJetStreamConsumer(logger, con, n.options.JetStream, n.options.Workers.MaxInFlight)
+		if err != nil {
+			logger.WithError(err).Error("Failed to create JetStream context")
+			return false
+		}
+		err = jetStream.provisionStream(n.options.Subjects.all())
+		if err != nil {
+			logger.WithError(err).Error("Failed to provision JetStream stream")
+			return false
+		}
+		n.jetStream = jetStream
+	}
+
+	if n.options.DeadLetter.Enabled {
+		deadLetter, err := newDeadLetterPublisher(logger, con, n.publisher, n.options.DeadLetter)
+		if err != nil {
+			logger.WithError(err).Error("Failed to provision dead letter publisher")
+			return false
+		}
+		n.deadLetter = deadLetter
+	}
+
+	if n.options.Events.Enabled {
+		n.events = newEventPublisher(n.publisher, n.options.Events)
+	}
 	return true
 }
 
@@ -63,9 +180,15 @@ func (n *NatsMessageProcessor) Shutdown() bool {
 	logger := n.logger
 
 	if n.connection != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), n.options.DrainTimeout)
+		defer cancel()
+		n.drain(ctx)
+
 		logger.Info("Shutting down NATS connection...")
+		n.state.closing.Store(true)
 		n.connection.Close()
 		logger.Info("Successful NATS connection shut down...")
+		// the publishers are kept for the handlers abandoned by the drain, their sends fail on the closed connection
 		n.connection = nil
 		return true
 	}
@@ -76,36 +199,94 @@ func (n *NatsMessageProcessor) Shutdown() bool {
 func (n *NatsMessageProcessor) Subscribe() bool {
 	logger := n.logger
 
-	for _, subject := range natsSubjects {
-		_, err := n.connection.Subscribe(subject, n.messageHandler)
+	for _, subject := range n.options.Subjects.all() {
+		pool := newWorkerPool(logger, subject, n.messageHandler, n.metrics, n.options.Workers)
+		if n.jetStream != nil {
+			pool.reject = n.jetStream.reject
+		}
+
+		queueGroup := n.options.QueueGroups[subject]
+		var subscription *nats.Subscription
+		var err error
+		switch {
+		case n.jetStream != nil:
+			subscription, err = n.jetStream.subscribe(subject, queueGroup, pool.dispatch)
+		case queueGroup != "":
+			subscription, err = n.connection.QueueSubscribe(subject, queueGroup, pool.dispatch)
+		default:
+			subscription, err = n.connection.Subscribe(subject, pool.dispatch)
+		}
+		// pull subscriptions buffer nothing, the fetches wait for the pool
+		if err == nil && (n.jetStream == nil || !n.options.JetStream.Pull) {
+			err = subscription.SetPendingLimits(n.options.Workers.PendingMessages, n.options.Workers.PendingBytes)
+		}
 		if err != nil {
+			pool.shutdown()
 			logger.WithError(err).WithFields(log.Fields{
-				"subject": subject,
+				"subject":     subject,
+				"queue_group": queueGroup,
 			}).Error("Could not subscribe to subject")
 			return false
 		}
+		n.subscriptionsMu.Lock()
+		n.subscriptions = append(n.subscriptions, &processorSubscription{
+			subject:      subject,
+			queueGroup:   queueGroup,
+			subscription: subscription,
+			pool:         pool,
+		})
+		n.subscriptionsMu.Unlock()
 	}
 	logger.WithFields(log.Fields{
-		"subjects": natsSubjects,
+		"subjects":     n.options.Subjects.all(),
+		"queue_groups": n.options.QueueGroups,
 	}).Info("Successfully subscribed to subject(s)")
 	return true
 }
 
+func (n *NatsMessageProcessor) ReplayDeadLetters() bool {
+	logger := n.logger
+
+	if n.deadLetter == nil {
+		logger.Error("Dead letters are disabled! No replay done...")
+		return false
+	}
+
+	logger.Info("Replaying dead letters...")
+	replayed, err := n.deadLetter.replay()
+	logger = logger.WithField("replayed", replayed)
+	if err != nil {
+		logger.WithError(err).Error("Failed to replay dead letters")
+		return false
+	}
+	logger.Info("Successfully replayed dead letters")
+	return true
+}
+
 func (n *NatsMessageProcessor) getOrCreateSpanForMessageProcessing(logger *log.Entry, context context.Context, msg *nats.Msg, name string) (context.Context, trace.Span) {
+	// set on start, so the sampler can take them into account
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.destination.name", msg.Subject),
+	}
+	if msg.Header != nil && msg.Header.Get(KarateTestIdAttribute) != "" {
+		attrs = append(attrs, attribute.String(KarateTestIdAttribute, msg.Header.Get(KarateTestIdAttribute)))
+	}
+
 	ctx := otel.GetTextMapPropagator().Extract(context, NatsHeaderCarrier(msg.Header))
 	testSpan := trace.SpanFromContext(ctx)
 	if !testSpan.SpanContext().IsValid() {
 		logger.WithContext(context).Info("Trace not found, generating new one.")
-		return n.tracer.Start(context, name, trace.WithNewRoot(), trace.WithSpanKind(trace.SpanKindConsumer))
+		return n.tracer.Start(context, name, trace.WithNewRoot(), trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...))
 	}
-	ctx, span := n.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindConsumer))
+	ctx, span := n.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...))
 	logger.WithContext(context).Info(fmt.Sprintf("Trace found with value: %s. reusing it", span.SpanContext().TraceID().String()))
 
 	return ctx, span
 }
 
 func (n *NatsMessageProcessor) messageHandler(msg *nats.Msg) {
-	logger := n.logger.WithFields(NewRequestFieldsToLogProvider(n.logger, msg).get())
+	requestFields := NewRequestFieldsToLogProvider(n.logger, msg).get()
+	logger := n.logger.WithFields(requestFields)
 	ctx, span := n.getOrCreateSpanForMessageProcessing(logger, context.Background(), msg, "Process message")
 	defer span.End()
 
@@ -118,80 +299,233 @@ func (n *NatsMessageProcessor) messageHandler(msg *nats.Msg) {
 	requestLogger.WithFields(debugFields).Info("Starting processing message")
 	defer requestLogger.WithFields(debugFields).Info("Ending processing message")
 
-	repository, err := db.NewDynamoDbRepository(ctx, n.tracer, requestLogger, tableName)
+	if n.jetStream != nil {
+		n.jetStream.inProgress(requestLogger, msg)
+	}
+
+	recordOutcome := n.metrics.start(ctx, msg.Subject)
+	repository := n.repositoryFactory(requestLogger)
+
+	handler, found := n.handlers[msg.Subject]
+	if !found {
+		handler.name = "unknown"
+	}
+
+	response, reservation := n.reserve(ctx, requestLogger, idempotencyKey(msg))
+	if response == nil {
+		if found {
+			response = handler.process(ctx, requestLogger, repository, msg)
+		} else {
+			requestLogger.WithFields(debugFields).Error("Unknown message subject. THIS SHOULD NEVER HAPPEN!")
+			response = newErrorResponse(ErrorCodeUnknownSubject, fmt.Errorf("unknown subject: %s", msg.Subject))
+		}
+	}
+	if !response.Replayed {
+		response.RequestId, _ = requestFields["requestId"].(string)
+		response.TraceId = span.SpanContext().TraceID().String()
+		n.complete(ctx, requestLogger, reservation, response)
+	}
+	recordOutcome(handler.name, response)
+
+	if response.event != nil && n.events != nil {
+		response.event.RequestId = response.RequestId
+		n.events.publish(ctx, requestLogger, response.event)
+	}
+
+	deadLetter := func(attempts uint64) error {
+		if n.deadLetter == nil {
+			return nil
+		}
+		return n.deadLetter.publish(ctx, requestLogger, msg, handler.name, response, attempts)
+	}
+	if n.jetStream != nil {
+		// the reply subject of a JetStream message is its ack subject, publishers get the stream ack instead
+		n.jetStream.settle(requestLogger, msg, response, deadLetter)
+		return
+	}
+	n.reply(ctx, requestLogger, msg, response)
+	// a replayed error was dead lettered with the original message
+	if response.IsError() && !response.Replayed && !response.isExpectedFailure() && !response.isInProgress() {
+		_ = deadLetter(1)
+	}
+}
+
+func (n *NatsMessageProcessor) reply(ctx context.Context, logger *log.Entry, msg *nats.Msg, response *Response) {
+	if msg.Reply == "" {
+		return
+	}
+
+	logger = logger.WithFields(log.Fields{
+		"reply":  msg.Reply,
+		"status": response.Status,
+	})
+
+	data, err := serializeResponse(response)
 	if err != nil {
-		requestLogger.WithError(err).Error("Failed to create repository")
+		logger.WithError(err).Error("Failed to serialize response")
 		return
 	}
 
-	switch msg.Subject {
-	case createSubject:
-		processCreateMessage(requestLogger, repository, msg)
-		break
-	case listSubject:
-		processListMessage(requestLogger, repository, msg)
-		break
-	case deleteSubject:
-		processDeleteMessage(requestLogger, repository, msg)
-		break
-	default:
-		requestLogger.WithFields(debugFields).Error("Unknown message subject. THIS SHOULD NEVER HAPPEN!")
-		break
+	err = n.publisher.Respond(ctx, msg, data)
+	if err != nil {
+		logger.WithError(err).Error("Failed to send response")
+		return
 	}
+	logger.Info("Response sent")
+}
 
-	//otel.GetTextMapPropagator().Inject(ctx, DebuggerCarrier{})
+// rejectMessage answers a message that could not be decoded or is not valid, with its field errors
+// on the processing span
+func rejectMessage(ctx context.Context, logger *log.Entry, err error) *Response {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		fieldErrors := make([]string, 0, len(validationErr.Fields))
+		for _, field := range validationErr.Fields {
+			fieldErrors = append(fieldErrors, field.String())
+		}
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Int("validation.error_count", len(fieldErrors)),
+			attribute.StringSlice("validation.errors", fieldErrors),
+		)
+		logger = logger.WithField("validation_errors", fieldErrors)
+	}
+	logger.WithError(err).Error("Failed to deserialize message")
+	return newDeserializationErrorResponse(err)
 }
 
-func processCreateMessage(logger *log.Entry, repository db.Repository, msg *nats.Msg) {
+// newRepositoryErrorResponse answers a failed repository operation, the expected failures (missing record,
+// failed condition, version conflict) are not logged as errors
+func newRepositoryErrorResponse(logger *log.Entry, operation string, err error) *Response {
+	var conflictErr *db.ConflictError
+	switch {
+	case errors.Is(err, db.ErrRecordNotFound):
+		logger.Info("Record not found")
+		return newErrorResponse(ErrorCodeNotFound, err)
+	case errors.Is(err, db.ErrConditionFailed):
+		logger.Info("Record does not match the condition")
+		return newErrorResponse(ErrorCodeConditionFailed, err)
+	case errors.As(err, &conflictErr):
+		logger.WithError(err).Info("Record version conflict")
+		return newErrorResponse(ErrorCodeConflict, err)
+	}
+	logger.WithError(err).Error("Failed to " + operation)
+	return newErrorResponse(ErrorCodeRepositoryFailure, err)
+}
+
+func processCreateMessage(ctx context.Context, logger *log.Entry, repository db.Repository, msg *nats.Msg) *Response {
 
 	logger.Info("Starting processing create record message")
 	defer logger.Info("End processing create record message")
 
 	message, err := deserializeCreateMessage(msg)
 	if err != nil {
-		logger.WithError(err).Error("Failed to deserialize message")
-		return
+		return rejectMessage(ctx, logger, err)
 	}
 
-	err = repository.Create(message.Key, message.Info)
+	record, err := repository.Create(ctx, message.Namespace, message.Key, message.Info, message.Overwrite)
 	if err != nil {
-		logger.WithError(err).Error("Failed to create record")
-		return
+		return newRepositoryErrorResponse(logger, "create record", err)
 	}
+
+	return newSuccessResponse(&CreateResult{
+		Namespace: record.Namespace,
+		Key:       record.Key,
+		Version:   record.Version,
+	}).withEvent(newRecordEvent(RecordCreatedEvent, *record))
 }
 
-func processListMessage(logger *log.Entry, repository db.Repository, msg *nats.Msg) {
+func processGetMessage(ctx context.Context, logger *log.Entry, repository db.Repository, msg *nats.Msg) *Response {
+
+	logger.Info("Starting processing get record message")
+	defer logger.Info("End processing get record message")
+
+	message, err := deserializeGetMessage(msg)
+	if err != nil {
+		return rejectMessage(ctx, logger, err)
+	}
+
+	record, err := repository.Get(ctx, message.Namespace, message.Key)
+	if err != nil {
+		return newRepositoryErrorResponse(logger, "get record", err)
+	}
+
+	return newSuccessResponse(&GetResult{
+		Record: *record,
+	})
+}
+
+func processListMessage(ctx context.Context, logger *log.Entry, repository db.Repository, msg *nats.Msg) *Response {
 
 	logger.Info("Starting processing list records message")
 	defer logger.Info("End processing list records message")
 
 	message, err := deserializeListMessage(msg)
 	if err != nil {
-		logger.WithError(err).Error("Failed to deserialize message")
-		return
+		return rejectMessage(ctx, logger, err)
 	}
 
-	err = repository.List(message.Key)
+	page, err := repository.List(ctx, message.Namespace, message.Key, message.Limit, message.Cursor)
+	// a cursor from another listing is a client error, not logged as an error that would fail the span
+	if errors.Is(err, db.ErrInvalidCursor) {
+		logger.WithError(err).Warn("Invalid list cursor")
+		return newErrorResponse(ErrorCodeInvalidMessage, err)
+	}
 	if err != nil {
 		logger.WithError(err).Error("Failed to list records ")
-		return
+		return newErrorResponse(ErrorCodeRepositoryFailure, err)
 	}
+
+	return newSuccessResponse(&ListResult{
+		Records:    page.Records,
+		NextCursor: page.NextCursor,
+	})
 }
 
-func processDeleteMessage(logger *log.Entry, repository db.Repository, msg *nats.Msg) {
+func processUpdateMessage(ctx context.Context, logger *log.Entry, repository db.Repository, msg *nats.Msg) *Response {
+
+	logger.Info("Starting processing update record message")
+	defer logger.Info("End processing update record message")
+
+	message, err := deserializeUpdateMessage(msg)
+	if err != nil {
+		return rejectMessage(ctx, logger, err)
+	}
+
+	record, err := repository.Update(ctx, message.Namespace, message.Key, message.Info, db.UpdateCondition{
+		ExpectedInfo:    message.ExpectedInfo,
+		ExpectedVersion: message.ExpectedVersion,
+	})
+	if err != nil {
+		return newRepositoryErrorResponse(logger, "update record", err)
+	}
+
+	return newSuccessResponse(&UpdateResult{
+		Record: *record,
+	}).withEvent(newRecordEvent(RecordUpdatedEvent, *record))
+}
+
+func processDeleteMessage(ctx context.Context, logger *log.Entry, repository db.Repository, msg *nats.Msg) *Response {
 
 	logger.Info("Starting processing delete message")
 	defer logger.Info("End processing delete message")
 
 	message, err := deserializeDeleteMessage(msg)
 	if err != nil {
-		logger.WithError(err).Error("Failed to deserialize message")
-		return
+		return rejectMessage(ctx, logger, err)
 	}
 
-	err = repository.Delete(message.Key)
+	deleted, err := repository.Delete(ctx, message.Namespace, message.Key, message.ExpectedVersion)
 	if err != nil {
-		logger.WithError(err).Error("Failed to delete record")
-		return
+		return newRepositoryErrorResponse(logger, "delete record", err)
+	}
+
+	response := newSuccessResponse(&DeleteResult{
+		Namespace: message.Namespace,
+		Key:       message.Key,
+	})
+	// deleting a missing record succeeds, but there is no record deleted to notify
+	if !deleted {
+		return response
 	}
+	return response.withEvent(newRecordEvent(RecordDeletedEvent, db.Record{Namespace: message.Namespace, Key: message.Key}))
 }
@@ -0,0 +1,322 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"log-trace-testing/pkg/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSubjects = Subjects{
+	Create: "create",
+	Get:    "get",
+	List:   "list",
+	Update: "update",
+	Delete: "delete",
+}
+
+const testReplySubject = "_INBOX.test"
+
+// testProcessor is a processor on the memory repository whose messages are recorded instead of sent
+type testProcessor struct {
+	*NatsMessageProcessor
+	sent     *sentMessages
+	recorder *tracetest.SpanRecorder
+}
+
+func newTestProcessor(t *testing.T, options ProcessorOptions, idempotencyStore db.IdempotencyStore, records ...db.Record) *testProcessor {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	tracer, recorder := newTestTracer(t)
+
+	store := db.NewMemoryStore()
+	repository := db.NewMemoryRepository(tracer, log.NewEntry(logger), store)
+	for _, record := range records {
+		_, err := repository.Create(context.Background(), record.Namespace, record.Key, record.Info, false)
+		if err != nil {
+			t.Fatalf("seeding %s/%s: %v", record.Namespace, record.Key, err)
+		}
+	}
+
+	options.Subjects = testSubjects
+	processor := NewNatsMessageProcessor(log.NewEntry(logger), tracer, noop.NewMeterProvider().Meter("test"),
+		db.NewMemoryRepositoryFactory(tracer, store), idempotencyStore, options)
+	metrics, err := newProcessorMetrics(processor.meter)
+	if err != nil {
+		t.Fatalf("metrics: %v", err)
+	}
+	processor.metrics = metrics
+	sent := &sentMessages{}
+	processor.publisher = &TracedPublisher{send: sent.send, tracer: tracer}
+	if options.Events.Enabled {
+		processor.events = newEventPublisher(processor.publisher, options.Events)
+	}
+	if options.DeadLetter.Enabled {
+		processor.deadLetter = &deadLetterPublisher{
+			logger:    processor.logger,
+			options:   options.DeadLetter,
+			publisher: processor.publisher,
+		}
+	}
+	return &testProcessor{NatsMessageProcessor: processor, sent: sent, recorder: recorder}
+}
+
+// newTestRequest builds a request with a reply subject, headers are given as name and value pairs
+func newTestRequest(t *testing.T, subject string, message any, headers ...string) *nats.Msg {
+	t.Helper()
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	msg := nats.NewMsg(subject)
+	msg.Reply = testReplySubject
+	msg.Data = data
+	for i := 0; i+1 < len(headers); i += 2 {
+		msg.Header.Set(headers[i], headers[i+1])
+	}
+	return msg
+}
+
+// testResponse is a Response whose data is kept to be decoded by each test
+type testResponse struct {
+	Status    string          `json:"status"`
+	Error     *ResponseError  `json:"error"`
+	RequestId string          `json:"requestId"`
+	TraceId   string          `json:"traceId"`
+	Data      json.RawMessage `json:"data"`
+	Replayed  bool            `json:"replayed"`
+}
+
+// responses decodes the replies sent by the processor, in order
+func (p *testProcessor) responses(t *testing.T) []testResponse {
+	t.Helper()
+	var responses []testResponse
+	for _, msg := range p.sent.bySubject(testReplySubject) {
+		var response testResponse
+		err := json.Unmarshal(msg.Data, &response)
+		if err != nil {
+			t.Fatalf("unmarshal response %q: %v", msg.Data, err)
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+// lastTraceId is the trace of the last processed message
+func (p *testProcessor) lastTraceId(t *testing.T) string {
+	t.Helper()
+	spans := p.recorder.Ended()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name() == "Process message" {
+			return spans[i].SpanContext().TraceID().String()
+		}
+	}
+	t.Fatal("no processing span recorded")
+	return ""
+}
+
+func TestMessageHandlerResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        func(t *testing.T) *nats.Msg
+		wantStatus string
+		wantCode   string
+		// fragment of the response data
+		wantData string
+	}{
+		{
+			name: "created",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "create", CreateMessage{Namespace: "tenant", Key: "new", Info: "info"})
+			},
+			wantStatus: ResponseStatusOk,
+			wantData:   `{"namespace":"tenant","key":"new","version":1}`,
+		},
+		{
+			name: "found",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "get", GetMessage{Namespace: "tenant", Key: "key"})
+			},
+			wantStatus: ResponseStatusOk,
+			wantData:   `"key":"key","info":"info","version":1`,
+		},
+		{
+			name: "not found",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "get", GetMessage{Namespace: "tenant", Key: "missing"})
+			},
+			wantStatus: ResponseStatusError,
+			wantCode:   ErrorCodeNotFound,
+		},
+		{
+			name: "invalid message",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "create", CreateMessage{Namespace: "tenant"})
+			},
+			wantStatus: ResponseStatusError,
+			wantCode:   ErrorCodeInvalidMessage,
+		},
+		{
+			name: "unsupported version",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "get", GetMessage{Namespace: "tenant", Key: "key"}, versionHeader, "V9")
+			},
+			wantStatus: ResponseStatusError,
+			wantCode:   ErrorCodeUnsupportedVersion,
+		},
+		{
+			name: "unknown subject",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "other", GetMessage{Namespace: "tenant", Key: "key"})
+			},
+			wantStatus: ResponseStatusError,
+			wantCode:   ErrorCodeUnknownSubject,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			processor := newTestProcessor(t, ProcessorOptions{}, nil, db.Record{Namespace: "tenant", Key: "key", Info: "info"})
+
+			processor.messageHandler(test.msg(t))
+
+			responses := processor.responses(t)
+			if len(responses) != 1 {
+				t.Fatalf("got %d responses, want 1", len(responses))
+			}
+			response := responses[0]
+			if response.Status != test.wantStatus {
+				t.Errorf("got status %q, want %q", response.Status, test.wantStatus)
+			}
+			code := ""
+			if response.Error != nil {
+				code = response.Error.Code
+			}
+			if code != test.wantCode {
+				t.Errorf("got error code %q, want %q", code, test.wantCode)
+			}
+			if !strings.Contains(string(response.Data), test.wantData) {
+				t.Errorf("got data %s, want %s", response.Data, test.wantData)
+			}
+			if response.RequestId == "" {
+				t.Error("response without a request id")
+			}
+			if traceId := processor.lastTraceId(t); response.TraceId != traceId {
+				t.Errorf("got trace id %q, want the processing trace %q", response.TraceId, traceId)
+			}
+		})
+	}
+}
+
+func TestProcessListMessageInvalidCursor(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	tracer, _ := newTestTracer(t)
+	repository := db.NewMemoryRepository(tracer, log.NewEntry(logger), db.NewMemoryStore())
+	msg := newTestRequest(t, "list", ListMessage{Namespace: "tenant", Cursor: "bm90LWpzb24"})
+
+	response := processListMessage(context.Background(), log.NewEntry(logger), repository, msg)
+
+	if !response.IsError() || response.Error.Code != ErrorCodeInvalidMessage {
+		t.Fatalf("got %+v, want an %s error", response, ErrorCodeInvalidMessage)
+	}
+	// error logs fail the processing span
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.ErrorLevel {
+			t.Errorf("got %s log %q, want no error logs", entry.Level, entry.Message)
+		}
+	}
+}
+
+func TestMessageHandlerContinuesTrace(t *testing.T) {
+	processor := newTestProcessor(t, ProcessorOptions{}, nil)
+	ctx, span := processor.tracer.Start(context.Background(), "Send request")
+	span.End()
+	msg := newTestRequest(t, "get", GetMessage{Namespace: "tenant", Key: "key"})
+	otel.GetTextMapPropagator().Inject(ctx, NatsHeaderCarrier(msg.Header))
+
+	processor.messageHandler(msg)
+
+	responses := processor.responses(t)
+	if len(responses) != 1 || responses[0].TraceId != span.SpanContext().TraceID().String() {
+		t.Errorf("got %v, want a response in the trace of the request", responses)
+	}
+}
+
+func TestMessageHandlerWithoutReply(t *testing.T) {
+	processor := newTestProcessor(t, ProcessorOptions{}, nil)
+	msg := newTestRequest(t, "create", CreateMessage{Namespace: "tenant", Key: "key"})
+	msg.Reply = ""
+
+	processor.messageHandler(msg)
+
+	if len(processor.sent.messages) != 0 {
+		t.Errorf("got %d messages sent, want none", len(processor.sent.messages))
+	}
+}
+
+func TestMessageHandlerReplaysDuplicates(t *testing.T) {
+	tests := []struct {
+		name            string
+		msg             func(t *testing.T) *nats.Msg
+		wantCode        string
+		wantDeadLetters int
+	}{
+		{
+			name: "success",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "create", CreateMessage{Namespace: "tenant", Key: "key"}, idempotencyKeyHeader, "1")
+			},
+		},
+		{
+			name: "expected failure",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "get", GetMessage{Namespace: "tenant", Key: "missing"}, idempotencyKeyHeader, "1")
+			},
+			wantCode: ErrorCodeNotFound,
+		},
+		{
+			name: "dead lettered once",
+			msg: func(t *testing.T) *nats.Msg {
+				return newTestRequest(t, "create", CreateMessage{Namespace: "tenant"}, idempotencyKeyHeader, "1")
+			},
+			wantCode:        ErrorCodeInvalidMessage,
+			wantDeadLetters: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := ProcessorOptions{DeadLetter: DeadLetterOptions{Enabled: true, Subject: "dead"}}
+			processor := newTestProcessor(t, options, db.NewMemoryIdempotencyStore(time.Hour, time.Minute))
+
+			processor.messageHandler(test.msg(t))
+			processor.messageHandler(test.msg(t))
+
+			responses := processor.responses(t)
+			if len(responses) != 2 {
+				t.Fatalf("got %d responses, want 2", len(responses))
+			}
+			original, replayed := responses[0], responses[1]
+			if original.Replayed || !replayed.Replayed {
+				t.Errorf("got replayed %t and %t, want only the duplicate replayed", original.Replayed, replayed.Replayed)
+			}
+			if replayed.RequestId != original.RequestId || replayed.TraceId != original.TraceId {
+				t.Error("replayed response is not the original one")
+			}
+			if replayed.Error != nil && replayed.Error.Code != test.wantCode || replayed.Error == nil && test.wantCode != "" {
+				t.Errorf("got error %v, want code %q", replayed.Error, test.wantCode)
+			}
+			if deadLetters := processor.sent.bySubject("dead"); len(deadLetters) != test.wantDeadLetters {
+				t.Errorf("got %d dead letters, want %d", len(deadLetters), test.wantDeadLetters)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package messaging
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracedPublisher wraps a NATS connection so every outgoing message gets a producer span and
+// carries the trace context (traceparent, tracestate and baggage) in its headers.
+type TracedPublisher struct {
+	// sends a core NATS message, the PublishMsg of the connection
+	send   func(msg *nats.Msg) error
+	tracer trace.Tracer
+}
+
+func NewTracedPublisher(connection *nats.Conn, tracer trace.Tracer) *TracedPublisher {
+	return &TracedPublisher{
+		send:   connection.PublishMsg,
+		tracer: tracer,
+	}
+}
+
+// PublishMsg publishes msg as a core NATS message.
+func (p *TracedPublisher) PublishMsg(ctx context.Context, msg *nats.Msg) error {
+	return p.publish(ctx, msg, false, p.send)
+}
+
+// PublishMsgToStream publishes msg with JetStream and waits for the stream ack.
+func (p *TracedPublisher) PublishMsgToStream(ctx context.Context, js nats.JetStreamContext, msg *nats.Msg) error {
+	return p.publish(ctx, msg, false, func(msg *nats.Msg) error {
+		_, err := js.PublishMsg(msg, nats.Context(ctx))
+		return err
+	})
+}
+
+// Respond sends data to the reply subject of request.
+func (p *TracedPublisher) Respond(ctx context.Context, request *nats.Msg, data []byte) error {
+	if request.Reply == "" {
+		return nats.ErrMsgNoReply
+	}
+	msg := nats.NewMsg(request.Reply)
+	msg.Data = data
+	return p.publish(ctx, msg, true, p.send)
+}
+
+func (p *TracedPublisher) publish(ctx context.Context, msg *nats.Msg, temporary bool, send func(msg *nats.Msg) error) error {
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", "nats"),
+		attribute.String("messaging.operation", "publish"),
+		attribute.Int("messaging.message.body.size", len(msg.Data)),
+	}
+	if temporary {
+		// reply inboxes are unique per request, they are only kept as a flag
+		attrs = append(attrs, attribute.Bool("messaging.destination.temporary", true))
+	} else {
+		attrs = append(attrs, attribute.String("messaging.destination.name", msg.Subject))
+	}
+
+	ctx, span := p.tracer.Start(ctx, "Publish message", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attrs...))
+	defer span.End()
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, NatsHeaderCarrier(msg.Header))
+
+	err := send(msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"testing"
+)
+
+// newTestTracer records the ended spans and installs the propagators of the service
+func newTestTracer(t *testing.T) (trace.Tracer, *tracetest.SpanRecorder) {
+	t.Helper()
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() {
+		otel.SetTextMapPropagator(propagator)
+	})
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return provider.Tracer("test"), recorder
+}
+
+// sentMessages records the messages of a TracedPublisher instead of sending them
+type sentMessages struct {
+	mu       sync.Mutex
+	messages []*nats.Msg
+	err      error
+}
+
+func (s *sentMessages) send(msg *nats.Msg) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+func (s *sentMessages) bySubject(subject string) []*nats.Msg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []*nats.Msg
+	for _, msg := range s.messages {
+		if msg.Subject == subject {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracedPublisher(t *testing.T) {
+	sendErr := errors.New("connection closed")
+	tests := []struct {
+		name            string
+		publish         func(ctx context.Context, publisher *TracedPublisher) error
+		sendErr         error
+		wantErr         error
+		wantSubject     string
+		wantDestination string
+		wantTemporary   bool
+	}{
+		{
+			name: "publish",
+			publish: func(ctx context.Context, publisher *TracedPublisher) error {
+				return publisher.PublishMsg(ctx, &nats.Msg{Subject: "events", Data: []byte("data")})
+			},
+			wantSubject:     "events",
+			wantDestination: "events",
+		},
+		{
+			name: "respond",
+			publish: func(ctx context.Context, publisher *TracedPublisher) error {
+				return publisher.Respond(ctx, &nats.Msg{Subject: "get", Reply: "_INBOX.1"}, []byte("data"))
+			},
+			wantSubject:   "_INBOX.1",
+			wantTemporary: true,
+		},
+		{
+			name: "failed publish",
+			publish: func(ctx context.Context, publisher *TracedPublisher) error {
+				return publisher.PublishMsg(ctx, &nats.Msg{Subject: "events"})
+			},
+			sendErr:         sendErr,
+			wantErr:         sendErr,
+			wantDestination: "events",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracer, recorder := newTestTracer(t)
+			sent := &sentMessages{err: test.sendErr}
+			publisher := &TracedPublisher{send: sent.send, tracer: tracer}
+
+			ctx, parent := tracer.Start(context.Background(), "Process message")
+			err := test.publish(ctx, publisher)
+			parent.End()
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got %v, want %v", err, test.wantErr)
+			}
+
+			spans := recorder.Ended()
+			if len(spans) != 2 {
+				t.Fatalf("got %d spans, want the producer and its parent", len(spans))
+			}
+			span := spans[0]
+			if span.Name() != "Publish message" || span.SpanKind() != trace.SpanKindProducer {
+				t.Errorf("got span %q of kind %v, want a producer span", span.Name(), span.SpanKind())
+			}
+			if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Error("producer span is not a child of the context span")
+			}
+			destination, _ := spanAttribute(span, "messaging.destination.name")
+			temporary, _ := spanAttribute(span, "messaging.destination.temporary")
+			if destination.AsString() != test.wantDestination || temporary.AsBool() != test.wantTemporary {
+				t.Errorf("got destination %q temporary %t, want %q temporary %t",
+					destination.AsString(), temporary.AsBool(), test.wantDestination, test.wantTemporary)
+			}
+			if test.wantErr != nil {
+				if span.Status().Code != codes.Error {
+					t.Errorf("got status %v, want an error", span.Status())
+				}
+				return
+			}
+
+			if len(sent.messages) != 1 || sent.messages[0].Subject != test.wantSubject {
+				t.Fatalf("got %v, want one message on %s", sent.messages, test.wantSubject)
+			}
+			// the consumers continue the trace from the producer span
+			ctx = otel.GetTextMapPropagator().Extract(context.Background(), NatsHeaderCarrier(sent.messages[0].Header))
+			remote := trace.SpanContextFromContext(ctx)
+			if remote.TraceID() != span.SpanContext().TraceID() || remote.SpanID() != span.SpanContext().SpanID() {
+				t.Errorf("got traceparent %q, want the producer span", sent.messages[0].Header.Get("traceparent"))
+			}
+		})
+	}
+}
+
+func TestTracedPublisherRespondWithoutReply(t *testing.T) {
+	tracer, recorder := newTestTracer(t)
+	sent := &sentMessages{}
+	publisher := &TracedPublisher{send: sent.send, tracer: tracer}
+
+	err := publisher.Respond(context.Background(), &nats.Msg{Subject: "create"}, []byte("data"))
+	if !errors.Is(err, nats.ErrMsgNoReply) {
+		t.Errorf("got %v, want %v", err, nats.ErrMsgNoReply)
+	}
+	if len(sent.messages) != 0 || len(recorder.Ended()) != 0 {
+		t.Error("response sent without a reply subject")
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"strconv"
 )
 
+// KarateTestIdAttribute is the header, log field and span attribute identifying integration test messages
+const KarateTestIdAttribute = "karate-test-id"
+
 type RequestProvider interface {
 	get() map[string]string
 }
@@ -38,6 +41,22 @@ func (s SubjectNameProvider) get() map[string]string {
 	return map[string]string{"subject": s.msg.Subject}
 }
 
+type MessageVersionProvider struct {
+	msg *nats.Msg
+}
+
+func NewMessageVersionProvider(msg *nats.Msg) *MessageVersionProvider {
+	return &MessageVersionProvider{msg: msg}
+}
+
+func (m MessageVersionProvider) get() map[string]string {
+	version := m.msg.Header.Get(versionHeader)
+	if version == "" {
+		version = CurrentMessageVersion
+	}
+	return map[string]string{"message_version": version}
+}
+
 type TraceIdProvider struct {
 	logger *log.Entry
 	msg    *nats.Msg
@@ -86,10 +105,10 @@ func (t KarateTestIdProvider) get() map[string]string {
 	var trace map[string]string = nil
 
 	if t.msg.Header != nil {
-		testId := t.msg.Header.Get("karate-test-id")
+		testId := t.msg.Header.Get(KarateTestIdAttribute)
 		if testId != "" {
 			trace = map[string]string{
-				"karate-test-id":      testId,
+				KarateTestIdAttribute: testId,
 				"is-integration-test": strconv.FormatBool(true),
 			}
 		}
@@ -117,6 +136,7 @@ func (r RequestFieldsToLogProvider) get() log.Fields {
 
 	providers := []RequestProvider{
 		NewSubjectNameProvider(r.msg),
+		NewMessageVersionProvider(r.msg),
 		NewRequestIdProvider(),
 		//NewTraceIdProvider(r.logger, r.msg),
 		NewKarateTestIdProvider(r.logger, r.msg),
@@ -0,0 +1,51 @@
+package messaging
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// processorSubscription is the subscription of a subject and the pool processing its messages
+type processorSubscription struct {
+	subject      string
+	queueGroup   string
+	subscription *nats.Subscription
+	pool         *workerPool
+}
+
+// SubscriptionState is a snapshot of a subject subscription, for the health checks and diagnostics
+type SubscriptionState struct {
+	Subject    string `json:"subject"`
+	QueueGroup string `json:"queueGroup,omitempty"`
+	Active     bool   `json:"active"`
+	// messages buffered by the subscription, waiting for the pool
+	PendingMessages int   `json:"pendingMessages"`
+	PendingBytes    int   `json:"pendingBytes"`
+	Delivered       int64 `json:"delivered"`
+	Dropped         int   `json:"dropped"`
+	// messages in the pool, waiting for a worker or being processed
+	Queued     int   `json:"queued"`
+	Processing int64 `json:"processing"`
+}
+
+// Subscriptions returns the state of the subject subscriptions, empty before Subscribe and after Shutdown
+func (n *NatsMessageProcessor) Subscriptions() []SubscriptionState {
+	n.subscriptionsMu.RLock()
+	defer n.subscriptionsMu.RUnlock()
+
+	states := make([]SubscriptionState, 0, len(n.subscriptions))
+	for _, s := range n.subscriptions {
+		state := SubscriptionState{
+			Subject:    s.subject,
+			QueueGroup: s.queueGroup,
+			Active:     s.subscription.IsValid() && !s.subscription.IsDraining(),
+			Queued:     s.pool.queued(),
+			Processing: s.pool.busy.Load(),
+		}
+		// the counters fail once the subscription is closed
+		state.PendingMessages, state.PendingBytes, _ = s.subscription.Pending()
+		state.Delivered, _ = s.subscription.Delivered()
+		state.Dropped, _ = s.subscription.Dropped()
+		states = append(states, state)
+	}
+	return states
+}
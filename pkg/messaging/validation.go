@@ -0,0 +1,203 @@
+package messaging
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// patterns allowed by the pattern validation rule, by name
+var validationPatterns = map[string]*regexp.Regexp{
+	"namespace": regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`),
+	"key":       regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/@-]*$`),
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (f FieldError) String() string {
+	return f.Field + ": " + f.Message
+}
+
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.String())
+	}
+	return "invalid message: " + strings.Join(messages, ", ")
+}
+
+// validationRule checks one field value, returning the message of the violation, if any
+type validationRule struct {
+	name  string
+	check func(value reflect.Value) string
+}
+
+type fieldRules struct {
+	index int
+	name  string
+	rules []validationRule
+}
+
+var validationRulesCache sync.Map
+
+// validate checks the `validate` struct tag rules of message, a pointer to a struct. Only required
+// applies to nil pointer fields, the other rules check the pointed value:
+//
+//	required      the field must not be empty
+//	max=N         strings of at most N characters, numbers up to N
+//	min=N         numbers from N
+//	pattern=NAME  non empty strings matching the NAME pattern of validationPatterns
+func validate(message any) error {
+	value := reflect.ValueOf(message).Elem()
+
+	var fieldErrors []FieldError
+	for _, field := range structRules(value.Type()) {
+		fieldValue := value.Field(field.index)
+		for _, rule := range field.rules {
+			violation := rule.check(fieldValue)
+			if violation != "" {
+				fieldErrors = append(fieldErrors, FieldError{Field: field.name, Rule: rule.name, Message: violation})
+				// the other rules of an empty or too long field only add noise
+				break
+			}
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return &ValidationError{Fields: fieldErrors}
+	}
+	return nil
+}
+
+func structRules(structType reflect.Type) []fieldRules {
+	if cached, found := validationRulesCache.Load(structType); found {
+		return cached.([]fieldRules)
+	}
+
+	var fields []fieldRules
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+
+		rules := fieldRules{index: i, name: name}
+		for _, definition := range strings.Split(tag, ",") {
+			rules.rules = append(rules.rules, parseRule(structType, field, definition))
+		}
+		fields = append(fields, rules)
+	}
+
+	validationRulesCache.Store(structType, fields)
+	return fields
+}
+
+// parseRule panics on invalid rules, they are a programming error
+func parseRule(structType reflect.Type, field reflect.StructField, definition string) validationRule {
+	name, argument, _ := strings.Cut(definition, "=")
+	invalid := func() {
+		panic(fmt.Sprintf("invalid validation rule %q of %s.%s", definition, structType.Name(), field.Name))
+	}
+	number := func() int64 {
+		n, err := strconv.ParseInt(argument, 10, 64)
+		if err != nil {
+			invalid()
+		}
+		return n
+	}
+
+	rule := validationRule{name: name}
+	switch name {
+	case "required":
+		rule.check = func(value reflect.Value) string {
+			if value.IsZero() {
+				return "is required"
+			}
+			return ""
+		}
+	case "max":
+		limit := number()
+		rule.check = func(value reflect.Value) string {
+			value, present := indirect(value)
+			if !present {
+				return ""
+			}
+			switch value.Kind() {
+			case reflect.String:
+				if int64(utf8.RuneCountInString(value.String())) > limit {
+					return fmt.Sprintf("must have at most %d characters", limit)
+				}
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				if value.Int() > limit {
+					return fmt.Sprintf("must be at most %d", limit)
+				}
+			default:
+				invalid()
+			}
+			return ""
+		}
+	case "min":
+		limit := number()
+		rule.check = func(value reflect.Value) string {
+			value, present := indirect(value)
+			if !present {
+				return ""
+			}
+			switch value.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				if value.Int() < limit {
+					return fmt.Sprintf("must be at least %d", limit)
+				}
+			default:
+				invalid()
+			}
+			return ""
+		}
+	case "pattern":
+		pattern, found := validationPatterns[argument]
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if !found || fieldType.Kind() != reflect.String {
+			invalid()
+		}
+		rule.check = func(value reflect.Value) string {
+			value, present := indirect(value)
+			if present && value.String() != "" && !pattern.MatchString(value.String()) {
+				return fmt.Sprintf("must match %s", pattern.String())
+			}
+			return ""
+		}
+	default:
+		invalid()
+	}
+	return rule
+}
+
+// indirect dereferences pointer fields, present is false for a nil pointer
+func indirect(value reflect.Value) (reflect.Value, bool) {
+	if value.Kind() != reflect.Pointer {
+		return value, true
+	}
+	if value.IsNil() {
+		return value, false
+	}
+	return value.Elem(), true
+}
@@ -0,0 +1,92 @@
+package messaging
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
+
+func fieldRuleNames(err error) []string {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		return nil
+	}
+	names := make([]string, 0, len(validationErr.Fields))
+	for _, field := range validationErr.Fields {
+		names = append(names, field.Field+":"+field.Rule)
+	}
+	return names
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		message any
+		want    []string
+	}{
+		{name: "valid create", message: &CreateMessage{Namespace: "tenant-1", Key: "orders/2024:01@a.b", Info: "info"}},
+		{name: "missing fields", message: &CreateMessage{}, want: []string{"namespace:required", "key:required"}},
+		{name: "namespace pattern", message: &CreateMessage{Namespace: "-tenant", Key: "key"}, want: []string{"namespace:pattern"}},
+		{name: "key pattern", message: &GetMessage{Namespace: "tenant", Key: "key with spaces"}, want: []string{"key:pattern"}},
+		{name: "namespace too long", message: &GetMessage{Namespace: strings.Repeat("n", 65), Key: "key"}, want: []string{"namespace:max"}},
+		{name: "max counts characters", message: &CreateMessage{Namespace: "tenant", Key: "key", Info: strings.Repeat("é", 4096)}},
+		{name: "info too long", message: &CreateMessage{Namespace: "tenant", Key: "key", Info: strings.Repeat("i", 4097)}, want: []string{"info:max"}},
+		{name: "empty list prefix", message: &ListMessage{Namespace: "tenant"}},
+		{name: "negative limit", message: &ListMessage{Namespace: "tenant", Limit: -1}, want: []string{"limit:min"}},
+		{name: "nil expected version", message: &UpdateMessage{Namespace: "tenant", Key: "key"}},
+		{name: "expected version", message: &UpdateMessage{Namespace: "tenant", Key: "key", ExpectedVersion: int64Ptr(1)}},
+		{name: "zero expected version", message: &DeleteMessage{Namespace: "tenant", Key: "key", ExpectedVersion: int64Ptr(0)}, want: []string{"expectedVersion:min"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validate(test.message)
+			if got := fieldRuleNames(err); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v (%v), want %v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestStructRulesPanicsOnInvalidRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		message any
+	}{
+		{name: "unknown rule", message: struct {
+			Field string `validate:"unknown"`
+		}{}},
+		{name: "max without number", message: struct {
+			Field string `validate:"max=many"`
+		}{}},
+		{name: "min of a string", message: struct {
+			Field string `validate:"min=1"`
+		}{}},
+		{name: "unknown pattern", message: struct {
+			Field string `validate:"pattern=unknown"`
+		}{}},
+		{name: "pattern of a number", message: struct {
+			Field int `validate:"pattern=key"`
+		}{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("invalid rule accepted")
+				}
+			}()
+			value := reflect.ValueOf(test.message)
+			// the rules checking the field kind only panic when they run
+			for _, field := range structRules(value.Type()) {
+				for _, rule := range field.rules {
+					rule.check(value.Field(field.index))
+				}
+			}
+		})
+	}
+}
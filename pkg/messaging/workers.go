@@ -0,0 +1,197 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+type WorkerOptions struct {
+	// workers processing the messages of each subject concurrently
+	Workers int
+	// messages of a subject queued or being processed, the delivery blocks when it is reached
+	MaxInFlight int
+	// messages with the same namespace and key are processed in order, by the same worker
+	OrderByKey bool
+	// limits of the messages buffered by a subscription while the pool is full, the messages above
+	// are dropped (slow consumer), negative for no limit
+	PendingMessages int
+	PendingBytes    int
+}
+
+// workerPool processes the messages of one subject with a fixed number of workers. Without ordering
+// all the workers share one queue, with ordering each worker has its own queue and the messages are
+// routed by key.
+type workerPool struct {
+	logger  *log.Entry
+	subject string
+	handler nats.MsgHandler
+	// optional, hands back the messages the pool rejects once it is closed
+	reject  nats.MsgHandler
+	metrics *processorMetrics
+	queues  []chan *nats.Msg
+	// mu guards the queues, no message is queued once they are closed
+	mu       sync.RWMutex
+	closed   bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+	busy     atomic.Int64
+	rejected atomic.Int64
+}
+
+func newWorkerPool(logger *log.Entry, subject string, handler nats.MsgHandler, metrics *processorMetrics, options WorkerOptions) *workerPool {
+	pool := &workerPool{
+		logger: logger.WithFields(log.Fields{
+			"subject":      subject,
+			"workers":      options.Workers,
+			"order_by_key": options.OrderByKey,
+		}),
+		subject: subject,
+		handler: handler,
+		metrics: metrics,
+		stop:    make(chan struct{}),
+	}
+
+	// the in flight messages are the queued ones plus one per worker
+	capacity := max(options.MaxInFlight-options.Workers, 0)
+	if options.OrderByKey {
+		for range options.Workers {
+			pool.queues = append(pool.queues, make(chan *nats.Msg, capacity/options.Workers))
+		}
+		for _, queue := range pool.queues {
+			pool.start(queue)
+		}
+	} else {
+		queue := make(chan *nats.Msg, capacity)
+		pool.queues = []chan *nats.Msg{queue}
+		for range options.Workers {
+			pool.start(queue)
+		}
+	}
+	return pool
+}
+
+func (p *workerPool) start(queue chan *nats.Msg) {
+	p.workers.Add(1)
+	go func() {
+		defer p.workers.Done()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case msg, ok := <-queue:
+				if !ok {
+					return
+				}
+				p.metrics.queued.Add(context.Background(), -1, metric.WithAttributes(attribute.String("messaging.destination.name", p.subject)))
+				p.busy.Add(1)
+				p.handler(msg)
+				p.busy.Add(-1)
+			}
+		}
+	}()
+}
+
+// dispatch queues a message for the workers, blocking while the pool is full so the subscription
+// buffers the messages (up to its pending limits) instead of the pool
+func (p *workerPool) dispatch(msg *nats.Msg) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		// only JetStream deliveries can arrive this late
+		p.rejectMsg(msg, "Worker pool closed, message not processed")
+		return
+	}
+
+	queue := p.queues[0]
+	if len(p.queues) > 1 {
+		queue = p.queues[orderingHash(msg)%uint32(len(p.queues))]
+	}
+
+	select {
+	case queue <- msg:
+	default:
+		p.logger.Warn("Worker pool full, waiting for a free slot")
+		select {
+		case queue <- msg:
+		case <-p.stop:
+			p.rejectMsg(msg, "Worker pool stopped, message not processed")
+			return
+		}
+	}
+	p.metrics.queued.Add(context.Background(), 1, metric.WithAttributes(attribute.String("messaging.destination.name", p.subject)))
+}
+
+func (p *workerPool) rejectMsg(msg *nats.Msg, reason string) {
+	p.rejected.Add(1)
+	p.logger.Warn(reason)
+	if p.reject != nil {
+		p.reject(msg)
+	}
+}
+
+// drain closes the pool to new messages and waits until the workers processed the queued ones, or
+// the context is done. It returns the messages abandoned: rejected, still queued or being processed.
+func (p *workerPool) drain(ctx context.Context) int64 {
+	done := make(chan struct{})
+	go func() {
+		// a delivery waiting for a free slot holds the lock, until it is queued or the pool is stopped
+		p.mu.Lock()
+		if !p.closed {
+			p.closed = true
+			for _, queue := range p.queues {
+				close(queue)
+			}
+		}
+		p.mu.Unlock()
+		p.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return p.rejected.Load()
+	case <-ctx.Done():
+		return p.shutdown()
+	}
+}
+
+// shutdown stops the workers after their current message, without waiting for it, and returns the
+// messages abandoned
+func (p *workerPool) shutdown() int64 {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	return p.rejected.Load() + p.busy.Load() + int64(p.queued())
+}
+
+// queued returns the messages waiting for a worker
+func (p *workerPool) queued() int {
+	queued := 0
+	for _, queue := range p.queues {
+		queued += len(queue)
+	}
+	return queued
+}
+
+// orderingHash routes the messages of the same record to the same worker
+func orderingHash(msg *nats.Msg) uint32 {
+	var target struct {
+		Namespace string `json:"namespace"`
+		Key       string `json:"key"`
+	}
+	// an invalid payload is rejected by its handler, any worker will do
+	_ = json.Unmarshal(msg.Data, &target)
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(namespaceOrDefault(target.Namespace)))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write([]byte(target.Key))
+	return hash.Sum32()
+}
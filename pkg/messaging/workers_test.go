@@ -0,0 +1,203 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/metric/noop"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type orderedMessage struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Sequence  int    `json:"sequence"`
+}
+
+func newTestPool(t *testing.T, handler nats.MsgHandler, options WorkerOptions) *workerPool {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	metrics, err := newProcessorMetrics(noop.NewMeterProvider().Meter("test"))
+	if err != nil {
+		t.Fatalf("metrics: %v", err)
+	}
+	return newWorkerPool(log.NewEntry(logger), "subject", handler, metrics, options)
+}
+
+func newOrderedMsg(t *testing.T, message orderedMessage) *nats.Msg {
+	t.Helper()
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return &nats.Msg{Subject: "subject", Data: data}
+}
+
+func TestWorkerPoolProcessesEveryMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		options WorkerOptions
+		count   int
+	}{
+		{name: "shared queue", options: WorkerOptions{Workers: 3, MaxInFlight: 10}, count: 50},
+		{name: "queue per worker", options: WorkerOptions{Workers: 3, MaxInFlight: 10, OrderByKey: true}, count: 50},
+		{name: "no queue", options: WorkerOptions{Workers: 2, MaxInFlight: 2}, count: 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			processed := 0
+			pool := newTestPool(t, func(*nats.Msg) {
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				processed++
+				mu.Unlock()
+			}, test.options)
+
+			for i := range test.count {
+				pool.dispatch(newOrderedMsg(t, orderedMessage{Key: fmt.Sprintf("key%d", i)}))
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if abandoned := pool.drain(ctx); abandoned != 0 {
+				t.Errorf("got %d messages abandoned, want 0", abandoned)
+			}
+			if processed != test.count {
+				t.Errorf("got %d messages processed, want %d", processed, test.count)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolOrderByKey(t *testing.T) {
+	var mu sync.Mutex
+	sequences := map[string][]int{}
+	pool := newTestPool(t, func(msg *nats.Msg) {
+		message := orderedMessage{}
+		_ = json.Unmarshal(msg.Data, &message)
+		// uneven durations would reorder the messages of a key shared by several workers
+		time.Sleep(time.Duration(message.Sequence%3) * time.Millisecond)
+		mu.Lock()
+		sequences[message.Namespace+"/"+message.Key] = append(sequences[message.Namespace+"/"+message.Key], message.Sequence)
+		mu.Unlock()
+	}, WorkerOptions{Workers: 4, MaxInFlight: 20, OrderByKey: true})
+
+	for sequence := range 20 {
+		for _, namespace := range []string{"", "tenant"} {
+			for key := range 5 {
+				pool.dispatch(newOrderedMsg(t, orderedMessage{Namespace: namespace, Key: fmt.Sprintf("key%d", key), Sequence: sequence}))
+			}
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pool.drain(ctx)
+
+	if len(sequences) != 10 {
+		t.Fatalf("got %d keys, want 10", len(sequences))
+	}
+	for key, got := range sequences {
+		if len(got) != 20 || !slices.IsSorted(got) {
+			t.Errorf("key %s processed in order %v", key, got)
+		}
+	}
+}
+
+func TestOrderingHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string
+		equal bool
+	}{
+		{name: "same record", a: `{"namespace":"tenant","key":"key","info":"a"}`, b: `{"key":"key","namespace":"tenant","info":"b"}`, equal: true},
+		{name: "default namespace", a: `{"key":"key"}`, b: `{"namespace":"default","key":"key"}`, equal: true},
+		{name: "other namespace", a: `{"namespace":"tenant","key":"key"}`, b: `{"namespace":"other","key":"key"}`},
+		{name: "namespace and key are separated", a: `{"namespace":"ab","key":"c"}`, b: `{"namespace":"a","key":"bc"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := orderingHash(&nats.Msg{Data: []byte(test.a)})
+			b := orderingHash(&nats.Msg{Data: []byte(test.b)})
+			if (a == b) != test.equal {
+				t.Errorf("got hashes %d and %d, want equal %t", a, b, test.equal)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolDrainDeadline(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	pool := newTestPool(t, func(*nats.Msg) {
+		started <- struct{}{}
+		<-release
+	}, WorkerOptions{Workers: 1, MaxInFlight: 3})
+	defer close(release)
+
+	for i := range 3 {
+		pool.dispatch(newOrderedMsg(t, orderedMessage{Key: fmt.Sprintf("key%d", i)}))
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// one message being processed and two queued
+	if abandoned := pool.drain(ctx); abandoned != 3 {
+		t.Errorf("got %d messages abandoned, want 3", abandoned)
+	}
+}
+
+func TestWorkerPoolRejectsAfterDrain(t *testing.T) {
+	processed := make(chan *nats.Msg, 1)
+	pool := newTestPool(t, func(msg *nats.Msg) { processed <- msg }, WorkerOptions{Workers: 1, MaxInFlight: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if abandoned := pool.drain(ctx); abandoned != 0 {
+		t.Fatalf("got %d messages abandoned, want 0", abandoned)
+	}
+
+	pool.dispatch(newOrderedMsg(t, orderedMessage{Key: "late"}))
+	if abandoned := pool.drain(ctx); abandoned != 1 {
+		t.Errorf("got %d messages abandoned, want the late one", abandoned)
+	}
+	if len(processed) != 0 {
+		t.Error("late message processed")
+	}
+}
+
+func TestWorkerPoolShutdownUnblocksDispatch(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	pool := newTestPool(t, func(*nats.Msg) { <-release }, WorkerOptions{Workers: 1, MaxInFlight: 1})
+
+	// the worker takes the first message, the second waits for a free slot
+	pool.dispatch(newOrderedMsg(t, orderedMessage{Key: "first"}))
+	second := newOrderedMsg(t, orderedMessage{Key: "second"})
+	dispatched := make(chan struct{})
+	go func() {
+		pool.dispatch(second)
+		close(dispatched)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	pool.drain(ctx)
+
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch still blocked after the pool was stopped")
+	}
+	if rejected := pool.rejected.Load(); rejected != 1 {
+		t.Errorf("got %d messages rejected, want 1", rejected)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"log-trace-testing/pkg/config"
+	"log-trace-testing/pkg/messaging"
+	"sync"
+	"time"
+)
+
+func newSampler(cfg *config.Config) (sdktrace.Sampler, error) {
+	switch cfg.Sampling.Strategy {
+	case config.SamplingAlways:
+		return sdktrace.AlwaysSample(), nil
+	case config.SamplingRatio:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Sampling.Ratio)), nil
+	case config.SamplingRateLimited:
+		return sdktrace.ParentBased(newRateLimitedSampler(cfg.Sampling.TracesPerSecond)), nil
+	case config.SamplingRules:
+		return newRuleBasedSampler(sdktrace.TraceIDRatioBased(cfg.Sampling.Ratio)), nil
+	default:
+		return nil, fmt.Errorf("unknown sampling strategy: %s", cfg.Sampling.Strategy)
+	}
+}
+
+// rateLimitedSampler samples at most tracesPerSecond traces, a token bucket refilled continuously
+type rateLimitedSampler struct {
+	mutex           sync.Mutex
+	tracesPerSecond float64
+	tokens          float64
+	last            time.Time
+}
+
+func newRateLimitedSampler(tracesPerSecond float64) *rateLimitedSampler {
+	return &rateLimitedSampler{
+		tracesPerSecond: tracesPerSecond,
+		tokens:          tracesPerSecond,
+		last:            time.Now(),
+	}
+}
+
+func (r *rateLimitedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.tokens = min(r.tracesPerSecond, r.tokens+now.Sub(r.last).Seconds()*r.tracesPerSecond)
+	r.last = now
+
+	decision := sdktrace.Drop
+	if r.tokens >= 1 {
+		r.tokens--
+		decision = sdktrace.RecordAndSample
+	}
+	return sdktrace.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+func (r *rateLimitedSampler) Description() string {
+	return fmt.Sprintf("RateLimited{%g}", r.tracesPerSecond)
+}
+
+// ruleBasedSampler always keeps the traces of integration tests (karate-test-id attribute) and the
+// traces upstream already sampled; routine traffic is sampled by the routine sampler. The traces that
+// are not sampled are still recorded, so tailSamplingProcessor can export them if they end in error.
+type ruleBasedSampler struct {
+	routine sdktrace.Sampler
+}
+
+func newRuleBasedSampler(routine sdktrace.Sampler) sdktrace.Sampler {
+	return ruleBasedSampler{routine: routine}
+}
+
+func (r ruleBasedSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	parent := trace.SpanContextFromContext(p.ParentContext)
+	result := sdktrace.SamplingResult{Tracestate: parent.TraceState()}
+
+	switch {
+	case parent.IsValid() && parent.IsSampled():
+		result.Decision = sdktrace.RecordAndSample
+	case parent.IsValid() && !parent.IsRemote():
+		// the local root was not sampled, the decision is only taken when the trace ends
+		result.Decision = sdktrace.RecordOnly
+	case hasAttribute(p, messaging.KarateTestIdAttribute):
+		result.Decision = sdktrace.RecordAndSample
+	case r.routine.ShouldSample(p).Decision == sdktrace.RecordAndSample:
+		result.Decision = sdktrace.RecordAndSample
+	default:
+		result.Decision = sdktrace.RecordOnly
+	}
+	return result
+}
+
+func (r ruleBasedSampler) Description() string {
+	return fmt.Sprintf("RuleBased{routine:%s}", r.routine.Description())
+}
+
+func hasAttribute(p sdktrace.SamplingParameters, key string) bool {
+	for _, attr := range p.Attributes {
+		if string(attr.Key) == key && attr.Value.AsString() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// tailSamplingProcessor buffers the recorded but not sampled spans of each trace until its local root
+// span ends: if any of them ended in error the whole trace is exported, otherwise it is dropped.
+// At most maxTraces traces are buffered, the oldest ones are dropped first.
+type tailSamplingProcessor struct {
+	next      sdktrace.SpanProcessor
+	maxTraces int
+	mutex     sync.Mutex
+	traces    map[trace.TraceID]*list.Element
+	order     *list.List
+}
+
+type bufferedTrace struct {
+	traceID trace.TraceID
+	spans   []sdktrace.ReadOnlySpan
+	failed  bool
+}
+
+func newTailSamplingProcessor(next sdktrace.SpanProcessor, maxTraces int) *tailSamplingProcessor {
+	return &tailSamplingProcessor{
+		next:      next,
+		maxTraces: maxTraces,
+		traces:    map[trace.TraceID]*list.Element{},
+		order:     list.New(),
+	}
+}
+
+func (t *tailSamplingProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	t.next.OnStart(parent, s)
+}
+
+func (t *tailSamplingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		t.next.OnEnd(s)
+		return
+	}
+
+	traceID := s.SpanContext().TraceID()
+	isLocalRoot := !s.Parent().IsValid() || s.Parent().IsRemote()
+
+	t.mutex.Lock()
+	element, found := t.traces[traceID]
+	if !found {
+		element = t.order.PushBack(&bufferedTrace{traceID: traceID})
+		t.traces[traceID] = element
+		if t.order.Len() > t.maxTraces {
+			oldest := t.order.Remove(t.order.Front()).(*bufferedTrace)
+			delete(t.traces, oldest.traceID)
+		}
+	}
+	buffered := element.Value.(*bufferedTrace)
+	buffered.spans = append(buffered.spans, s)
+	buffered.failed = buffered.failed || s.Status().Code == codes.Error
+	if isLocalRoot {
+		t.order.Remove(element)
+		delete(t.traces, traceID)
+	}
+	t.mutex.Unlock()
+
+	if isLocalRoot && buffered.failed {
+		for _, span := range buffered.spans {
+			t.next.OnEnd(sampledSpan{span})
+		}
+	}
+}
+
+func (t *tailSamplingProcessor) Shutdown(ctx context.Context) error {
+	return t.next.Shutdown(ctx)
+}
+
+func (t *tailSamplingProcessor) ForceFlush(ctx context.Context) error {
+	return t.next.ForceFlush(ctx)
+}
+
+// sampledSpan flags a recorded span as sampled, so it is exported
+type sampledSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s sampledSpan) SpanContext() trace.SpanContext {
+	spanContext := s.ReadOnlySpan.SpanContext()
+	return spanContext.WithTraceFlags(spanContext.TraceFlags().WithSampled(true))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"log-trace-testing/pkg/config"
+	"log-trace-testing/pkg/messaging"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testTraceID = trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	testSpanID  = trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8}
+)
+
+// parentContext holds a parent span context, remote when it comes from a message
+func parentContext(sampled bool, remote bool) context.Context {
+	flags := trace.TraceFlags(0)
+	if sampled {
+		flags = trace.FlagsSampled
+	}
+	return trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    testTraceID,
+		SpanID:     testSpanID,
+		TraceFlags: flags,
+		Remote:     remote,
+	}))
+}
+
+func TestNewSampler(t *testing.T) {
+	tests := []struct {
+		strategy        string
+		wantDescription string
+		wantErr         bool
+	}{
+		{strategy: config.SamplingAlways, wantDescription: "AlwaysOnSampler"},
+		{strategy: config.SamplingRatio, wantDescription: "ParentBased{root:TraceIDRatioBased{0.5}"},
+		{strategy: config.SamplingRateLimited, wantDescription: "ParentBased{root:RateLimited{10}"},
+		{strategy: config.SamplingRules, wantDescription: "RuleBased{routine:TraceIDRatioBased{0.5}}"},
+		{strategy: "unknown", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			cfg := &config.Config{Sampling: config.SamplingConfig{Strategy: test.strategy, Ratio: 0.5, TracesPerSecond: 10}}
+			sampler, err := newSampler(cfg)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got %s, want an error", sampler.Description())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.HasPrefix(sampler.Description(), test.wantDescription) {
+				t.Errorf("got %s, want %s", sampler.Description(), test.wantDescription)
+			}
+		})
+	}
+}
+
+func TestRatioSampler(t *testing.T) {
+	tests := []struct {
+		name   string
+		ratio  float64
+		parent context.Context
+		want   sdktrace.SamplingDecision
+	}{
+		{name: "root never sampled", ratio: 0, parent: context.Background(), want: sdktrace.Drop},
+		{name: "root always sampled", ratio: 1, parent: context.Background(), want: sdktrace.RecordAndSample},
+		{name: "sampled upstream", ratio: 0, parent: parentContext(true, true), want: sdktrace.RecordAndSample},
+		{name: "dropped upstream", ratio: 1, parent: parentContext(false, true), want: sdktrace.Drop},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sampler, err := newSampler(&config.Config{Sampling: config.SamplingConfig{Strategy: config.SamplingRatio, Ratio: test.ratio}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			result := sampler.ShouldSample(sdktrace.SamplingParameters{ParentContext: test.parent, TraceID: testTraceID})
+			if result.Decision != test.want {
+				t.Errorf("got decision %v, want %v", result.Decision, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitedSampler(t *testing.T) {
+	sampler := newRateLimitedSampler(2)
+	params := sdktrace.SamplingParameters{ParentContext: context.Background(), TraceID: testTraceID}
+
+	sampled := 0
+	for range 5 {
+		if sampler.ShouldSample(params).Decision == sdktrace.RecordAndSample {
+			sampled++
+		}
+	}
+	if sampled != 2 {
+		t.Errorf("got %d traces sampled at once, want the 2 of the bucket", sampled)
+	}
+
+	// half a second refills one trace
+	sampler.last = sampler.last.Add(-500 * time.Millisecond)
+	if sampler.ShouldSample(params).Decision != sdktrace.RecordAndSample {
+		t.Error("trace dropped after the bucket was refilled")
+	}
+	if sampler.ShouldSample(params).Decision != sdktrace.Drop {
+		t.Error("trace sampled above the rate")
+	}
+}
+
+func TestRuleBasedSampler(t *testing.T) {
+	testAttribute := attribute.String(messaging.KarateTestIdAttribute, "test-1")
+	tests := []struct {
+		name       string
+		routine    sdktrace.Sampler
+		parent     context.Context
+		attributes []attribute.KeyValue
+		want       sdktrace.SamplingDecision
+	}{
+		{name: "sampled upstream", routine: sdktrace.NeverSample(), parent: parentContext(true, true), want: sdktrace.RecordAndSample},
+		{name: "local root not sampled", routine: sdktrace.AlwaysSample(), parent: parentContext(false, false), want: sdktrace.RecordOnly},
+		{name: "integration test", routine: sdktrace.NeverSample(), parent: context.Background(), attributes: []attribute.KeyValue{testAttribute}, want: sdktrace.RecordAndSample},
+		{name: "integration test dropped upstream", routine: sdktrace.NeverSample(), parent: parentContext(false, true), attributes: []attribute.KeyValue{testAttribute}, want: sdktrace.RecordAndSample},
+		{name: "empty integration test id", routine: sdktrace.NeverSample(), parent: context.Background(), attributes: []attribute.KeyValue{attribute.String(messaging.KarateTestIdAttribute, "")}, want: sdktrace.RecordOnly},
+		{name: "routine sampled", routine: sdktrace.AlwaysSample(), parent: context.Background(), want: sdktrace.RecordAndSample},
+		{name: "routine recorded only", routine: sdktrace.NeverSample(), parent: context.Background(), want: sdktrace.RecordOnly},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sampler := newRuleBasedSampler(test.routine)
+			result := sampler.ShouldSample(sdktrace.SamplingParameters{
+				ParentContext: test.parent,
+				TraceID:       testTraceID,
+				Attributes:    test.attributes,
+			})
+			if result.Decision != test.want {
+				t.Errorf("got decision %v, want %v", result.Decision, test.want)
+			}
+		})
+	}
+}
+
+// newTailSamplingTracer samples nothing upfront, the traces are only exported by the tail sampling
+func newTailSamplingTracer(maxTraces int) (trace.Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(newRuleBasedSampler(sdktrace.NeverSample())),
+		sdktrace.WithSpanProcessor(newTailSamplingProcessor(recorder, maxTraces)),
+	)
+	return provider.Tracer("test"), recorder
+}
+
+func TestTailSamplingProcessor(t *testing.T) {
+	tests := []struct {
+		name      string
+		failed    bool
+		attribute bool
+		wantSpans int
+	}{
+		{name: "trace ended in error", failed: true, wantSpans: 2},
+		{name: "trace ended successfully", wantSpans: 0},
+		{name: "trace sampled upfront", attribute: true, wantSpans: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracer, recorder := newTailSamplingTracer(10)
+
+			var options []trace.SpanStartOption
+			if test.attribute {
+				options = append(options, trace.WithAttributes(attribute.String(messaging.KarateTestIdAttribute, "test-1")))
+			}
+			ctx, root := tracer.Start(context.Background(), "Process message", options...)
+			_, child := tracer.Start(ctx, "Create record")
+			if test.failed {
+				child.SetStatus(codes.Error, "failed")
+			}
+			child.End()
+			if len(recorder.Ended()) != 0 && !test.attribute {
+				t.Fatal("span exported before the end of its trace")
+			}
+			root.End()
+
+			spans := recorder.Ended()
+			if len(spans) != test.wantSpans {
+				t.Fatalf("got %d spans exported, want %d", len(spans), test.wantSpans)
+			}
+			for _, span := range spans {
+				if !span.SpanContext().IsSampled() {
+					t.Errorf("span %s exported without the sampled flag", span.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestTailSamplingProcessorDropsOldestTraces(t *testing.T) {
+	tracer, recorder := newTailSamplingTracer(1)
+
+	oldCtx, oldRoot := tracer.Start(context.Background(), "Process message")
+	_, oldChild := tracer.Start(oldCtx, "Create record")
+	oldChild.SetStatus(codes.Error, "failed")
+	oldChild.End()
+	newCtx, newRoot := tracer.Start(context.Background(), "Process message")
+	_, newChild := tracer.Start(newCtx, "Create record")
+	newChild.End()
+
+	// the failed child was dropped from the buffer by the newer trace
+	oldRoot.End()
+	newRoot.End()
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Errorf("got %d spans exported, want none", len(spans))
+	}
+}
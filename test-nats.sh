@@ -1,6 +1,12 @@
 #!/bin/bash
 
+# the local NATS server requires the token s3cr3t: start the processor with its token, e.g.
+#   go run . -config config.example.yaml
+#   LTT_NATS_AUTH_MODE=token LTT_NATS_AUTH_TOKEN=s3cr3t go run .
+# plain `go run .` connects without authentication and fails with "Authorization Violation"
+
 # don't bother with s3cr3t
+# without namespace the record goes to the "default" namespace
 nats --server="nats://s3cr3t@localhost:4222" pub create '{"key":"key1", "info":"my-info"}' -H version:V1
 
 # com parent tracer
@@ -11,3 +17,18 @@ echo "Sending trace: ${full_trace}"
 # don't bother with s3cr3t
 nats --server="nats://s3cr3t@localhost:4222" pub create '{"key":"key2", "info":"my-info-sem-trace"}' -H version:V1 -H traceparent:"${full_trace}"
 
+
+# request/reply: waits for the processing outcome
+# V2 messages carry the namespace
+nats --server="nats://s3cr3t@localhost:4222" req create '{"namespace":"tenant1", "key":"key3", "info":"my-info-com-resposta"}' -H version:V2
+
+# list records by key prefix, page by page (pass the returned nextCursor as "cursor" to fetch the next page)
+nats --server="nats://s3cr3t@localhost:4222" req list '{"namespace":"tenant1", "key":"key", "limit":10}' -H version:V2
+
+# get one record, then update it only if nobody changed it meanwhile (CONFLICT otherwise)
+nats --server="nats://s3cr3t@localhost:4222" req get '{"namespace":"tenant1", "key":"key3"}' -H version:V2
+nats --server="nats://s3cr3t@localhost:4222" req update '{"namespace":"tenant1", "key":"key3", "info":"my-new-info", "expectedVersion":1}' -H version:V2
+
+# retried requests with the same id get the original response, the record is only created once
+nats --server="nats://s3cr3t@localhost:4222" req create '{"namespace":"tenant1", "key":"key4", "info":"only-once"}' -H version:V2 -H Nats-Msg-Id:create-key4
+nats --server="nats://s3cr3t@localhost:4222" req create '{"namespace":"tenant1", "key":"key4", "info":"only-once"}' -H version:V2 -H Nats-Msg-Id:create-key4